@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MotionAlertConfig struct {
+	// MinimumScore is the motion score a recording must reach to send an alert.
+	// If 0, motion alerts are disabled for this stream.
+	MinimumScore int `json:"minimum_score"`
+	// CooldownSeconds is how long after an alert further motion is ignored.
+	// Defaults to 300.
+	CooldownSeconds int `json:"cooldown_seconds"`
+	// QuietHours are times when no alerts are sent, in the server's local time
+	QuietHours []QuietHours `json:"quiet_hours"`
+}
+
+// Cooldown is CooldownSeconds with the default applied
+func (c MotionAlertConfig) Cooldown() time.Duration {
+	if c.CooldownSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(c.CooldownSeconds) * time.Second
+}
+
+type QuietHours struct {
+	// Start and End are times like "22:00" and "06:30".
+	// If End is before Start, the quiet hours end the next day.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Days are the days the quiet hours start on, like ["sat", "sun"].
+	// If empty, every day.
+	Days []string `json:"days"`
+}
+
+var quietHoursDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q QuietHours) validate() error {
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(q.End); err != nil {
+		return err
+	}
+	for _, day := range q.Days {
+		if !slices.Contains(quietHoursDays, strings.ToLower(day)) {
+			return fmt.Errorf("invalid day %q, expected one of %v", day, strings.Join(quietHoursDays, ", "))
+		}
+	}
+	return nil
+}
+
+// startsOn returns true if the quiet hours start on the given day
+func (q QuietHours) startsOn(day time.Weekday) bool {
+	return len(q.Days) == 0 || slices.ContainsFunc(q.Days, func(d string) bool { return strings.ToLower(d) == quietHoursDays[day] })
+}
+
+// Contains returns true if t is within the quiet hours
+func (q QuietHours) Contains(t time.Time) bool {
+	start, _ := parseClock(q.Start)
+	end, _ := parseClock(q.End)
+	minute := t.Hour()*60 + t.Minute()
+
+	if start <= end {
+		return minute >= start && minute < end && q.startsOn(t.Weekday())
+	}
+	// spans midnight: either the late part of today's window or the early part of yesterday's
+	if minute >= start {
+		return q.startsOn(t.Weekday())
+	}
+	return minute < end && q.startsOn(t.AddDate(0, 0, -1).Weekday())
+}
+
+type SMTPConfig struct {
+	// Host and Port of the mail server. Port defaults to 587.
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Username and Password are used for PLAIN authentication, if set
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TLS connects with implicit TLS, usually on port 465.
+	// Otherwise, STARTTLS is used if the server supports it.
+	TLS  bool     `json:"tls"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+// Enabled returns true if a mail server is configured
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != ""
+}
+
+func (c SMTPConfig) address() string {
+	port := c.Port
+	if port == 0 {
+		port = 587
+	}
+	return net.JoinHostPort(c.Host, strconv.Itoa(port))
+}
+
+// send sends an email with an optional JPEG attachment
+func (c SMTPConfig) send(ctx context.Context, subject, body string, jpeg []byte, jpegName string) error {
+	boundary := make([]byte, 16)
+	rand.Read(boundary)
+	boundaryString := hex.EncodeToString(boundary)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%v\r\n\r\n", boundaryString)
+	fmt.Fprintf(&msg, "--%v\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%v\r\n", boundaryString, body)
+	if len(jpeg) > 0 {
+		fmt.Fprintf(&msg, "--%v\r\nContent-Type: image/jpeg\r\nContent-Transfer-Encoding: base64\r\nContent-Disposition: attachment; filename=%q\r\n\r\n", boundaryString, jpegName)
+		encoded := base64.StdEncoding.EncodeToString(jpeg)
+		for len(encoded) > 76 {
+			msg.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		msg.WriteString(encoded + "\r\n")
+	}
+	fmt.Fprintf(&msg, "--%v--\r\n", boundaryString)
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if c.TLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: c.Host}}).DialContext(ctx, "tcp", c.address())
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.address())
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok && !c.TLS {
+		if err := client.StartTLS(&tls.Config{ServerName: c.Host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+type AlertsConfig struct {
+	// BaseURL is where the web UI is reachable, like "https://nvr.example.com".
+	// It is used to build links in alerts. If empty, links are relative.
+	BaseURL string `json:"base_url"`
+	// SMTP sends motion alerts by email, if configured
+	SMTP SMTPConfig `json:"smtp"`
+}
+
+type ApiV1MotionAlert struct {
+	RecordingID string `json:"recording_id"`
+	// PeakOffset is how many seconds into the recording the highest motion score was
+	PeakOffset int       `json:"peak_offset"`
+	PeakTime   time.Time `json:"peak_time"`
+	PeakScore  int       `json:"peak_score"`
+	// SnapshotPath is a frame from the peak second, if one could be extracted
+	SnapshotPath string `json:"snapshot_path,omitempty"`
+	// Link opens the recording at PeakOffset in the web UI
+	Link string `json:"link"`
+}
+
+// motionSnapshotPath is where the snapshot of a recording's motion alert is saved
+func motionSnapshotPath(recordingPath string) string {
+	return recordingPath + ".alert.jpg"
+}
+
+// extractSnapshot saves the frame at offset seconds into the recording as a JPEG
+func extractSnapshot(ctx context.Context, recordingPath string, offset int, snapshotPath string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-y",
+		"-ss", strconv.Itoa(offset),
+		"-i", recordingPath,
+		"-frames:v", "1",
+		"-q:v", "3",
+		snapshotPath,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("%v: %v", err, lines[len(lines)-1])
+	}
+	return nil
+}
+
+// Alerter sends motion alerts, enforcing each stream's cooldown and quiet hours
+type Alerter struct {
+	config AlertsConfig
+	inputs map[string]Input
+	mqtt   *MQTTClient
+	wg     sync.WaitGroup
+
+	lock      sync.Mutex
+	lastAlert map[string]time.Time
+}
+
+// NewAlerter validates the motion alert config of every input.
+// mqtt may be nil if MQTT isn't configured.
+func NewAlerter(config AlertsConfig, inputs []Input, mqtt *MQTTClient) (*Alerter, error) {
+	a := &Alerter{
+		config:    config,
+		inputs:    map[string]Input{},
+		mqtt:      mqtt,
+		lastAlert: map[string]time.Time{},
+	}
+	if config.SMTP.Enabled() && (config.SMTP.From == "" || len(config.SMTP.To) == 0) {
+		return nil, errors.New("smtp requires from and to")
+	}
+	for _, input := range inputs {
+		for _, quietHours := range input.MotionAlert.QuietHours {
+			if err := quietHours.validate(); err != nil {
+				return nil, fmt.Errorf("input %v has invalid quiet hours: %v", input.ID, err)
+			}
+		}
+		a.inputs[input.ID] = input
+	}
+	return a, nil
+}
+
+// link returns a link to the recording at the given offset in the web UI
+func (a *Alerter) link(recordingID string, offset int) string {
+	return fmt.Sprintf("%v/recordings/%v?t=%v", strings.TrimSuffix(a.config.BaseURL, "/"), url.PathEscape(recordingID), offset)
+}
+
+// Check sends an alert in the background if the recording's motion reaches the stream's threshold,
+// the stream isn't in its cooldown and it isn't quiet hours
+func (a *Alerter) Check(ctx context.Context, recording Recording, m []motion) {
+	input, ok := a.inputs[recording.InputID]
+	if !ok || input.MotionAlert.MinimumScore <= 0 {
+		return
+	}
+	logger := logger.WithField("unit", "alerts").WithField("stream", input.ID).WithField("recording", recording.ID)
+
+	peak := -1
+	for i := range m {
+		if m[i].Score >= input.MotionAlert.MinimumScore && (peak == -1 || m[i].Score > m[peak].Score) {
+			peak = i
+		}
+	}
+	if peak == -1 {
+		return
+	}
+	peakTime := recording.Start.Add(time.Duration(m[peak].Time) * time.Second)
+
+	for _, quietHours := range input.MotionAlert.QuietHours {
+		if quietHours.Contains(peakTime.Local()) {
+			logger.WithField("peak-time", peakTime).Debug("motion during quiet hours, not alerting")
+			return
+		}
+	}
+
+	a.lock.Lock()
+	lastAlert := a.lastAlert[input.ID]
+	if !lastAlert.IsZero() && peakTime.Sub(lastAlert) < input.MotionAlert.Cooldown() {
+		a.lock.Unlock()
+		logger.WithField("peak-time", peakTime).WithField("last-alert", lastAlert).Debug("motion during cooldown, not alerting")
+		return
+	}
+	a.lastAlert[input.ID] = peakTime
+	a.lock.Unlock()
+
+	alert := ApiV1MotionAlert{
+		RecordingID: recording.ID,
+		PeakOffset:  m[peak].Time,
+		PeakTime:    peakTime,
+		PeakScore:   m[peak].Score,
+		Link:        a.link(recording.ID, m[peak].Time),
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.send(ctx, input, recording, alert)
+	}()
+}
+
+func (a *Alerter) send(ctx context.Context, input Input, recording Recording, alert ApiV1MotionAlert) {
+	logger := logger.WithField("unit", "alerts").WithField("stream", input.ID).WithField("recording", recording.ID)
+
+	var snapshot []byte
+	snapshotPath := motionSnapshotPath(recording.Path)
+	if err := extractSnapshot(ctx, recording.Path, alert.PeakOffset, snapshotPath); err != nil {
+		logger.WithError(err).Warn("failed to extract motion snapshot, alerting without it")
+	} else if snapshot, err = os.ReadFile(snapshotPath); err != nil {
+		logger.WithError(err).Warn("failed to read motion snapshot, alerting without it")
+	} else {
+		alert.SnapshotPath = "/" + strings.TrimPrefix(snapshotPath, "/")
+	}
+
+	logger.WithField("peak-score", alert.PeakScore).WithField("peak-time", alert.PeakTime).Info("motion alert")
+	apiRecording := newApiV1Recording(recording, input.Name)
+	events.Publish(ApiV1Event{
+		Type:      EventMotionAlert,
+		StreamID:  input.ID,
+		Recording: &apiRecording,
+		Alert:     &alert,
+	})
+
+	message := fmt.Sprintf("Motion on %v at %v (score %v)", input.Name, alert.PeakTime.Local().Format("2006-01-02 15:04:05"), alert.PeakScore)
+
+	if a.mqtt != nil {
+		payload, _ := json.Marshal(struct {
+			ApiV1MotionAlert
+			StreamID   string `json:"stream_id"`
+			StreamName string `json:"stream_name"`
+			Message    string `json:"message"`
+		}{alert, input.ID, input.Name, message})
+		a.mqtt.Publish(a.mqtt.config.Topic(input.ID, "motion_alert"), false, payload)
+		if len(snapshot) > 0 {
+			a.mqtt.Publish(a.mqtt.config.Topic(input.ID, "motion_snapshot"), true, snapshot)
+		}
+	}
+
+	if a.config.SMTP.Enabled() {
+		sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		defer cancel()
+		if err := a.config.SMTP.send(sendCtx, message, message+"\n\n"+alert.Link, snapshot, path.Base(snapshotPath)); err != nil {
+			logger.WithError(err).Error("failed to send motion alert email")
+		}
+	}
+}
+
+// Wait blocks until every alert in progress has been sent
+func (a *Alerter) Wait() {
+	a.wg.Wait()
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type User struct {
+	// Username is used to log in to the web UI
+	Username string `json:"username"`
+	// PasswordHash is a bcrypt hash of this user's password.
+	// Generate one with `htpasswd -bnBC 10 "" "your-password" | tr -d ':\n'`
+	PasswordHash string `json:"password_hash"`
+	// APITokenHashes are hex-encoded SHA-256 hashes of bearer tokens that authenticate as this user.
+	// Generate a token with `openssl rand -hex 32` and hash it with `echo -n "your-token" | sha256sum`
+	APITokenHashes []string `json:"api_token_hashes"`
+	// Role determines what this user can do: "viewer", "reviewer" or "admin".
+	// Defaults to "admin" so configs written before roles existed keep working.
+	Role Role `json:"role"`
+	// Cameras are the Input IDs this user can access.
+	// If empty, this user can access every camera.
+	Cameras []string `json:"cameras"`
+}
+
+// Role determines what a user is allowed to do. Each role can do everything the previous one can.
+type Role string
+
+const (
+	// RoleViewer can watch live streams
+	RoleViewer Role = "viewer"
+	// RoleReviewer can also browse recordings
+	RoleReviewer Role = "reviewer"
+	// RoleAdmin can also restart streams and view metrics
+	RoleAdmin Role = "admin"
+)
+
+func (r Role) level() int {
+	switch r {
+	case RoleViewer:
+		return 1
+	case RoleReviewer:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// EffectiveRole is Role with the default applied
+func (u *User) EffectiveRole() Role {
+	if u.Role == "" {
+		return RoleAdmin
+	}
+	return u.Role
+}
+
+// HasRole returns true if the user has the given role or a more powerful one
+func (u *User) HasRole(role Role) bool {
+	return u.EffectiveRole().level() >= role.level()
+}
+
+// CanAccessCamera returns true if the user is allowed to see the given Input ID
+func (u *User) CanAccessCamera(inputID string) bool {
+	return len(u.Cameras) == 0 || slices.Contains(u.Cameras, inputID)
+}
+
+// CanAccessAllCameras returns true if the user is an admin allowed to see every input,
+// required for anything that affects all cameras at once
+func (u *User) CanAccessAllCameras(inputs []Input) bool {
+	if !u.HasRole(RoleAdmin) {
+		return false
+	}
+	for _, input := range inputs {
+		if !u.CanAccessCamera(input.ID) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanAccessMedia returns true if the user is allowed to fetch the given path from the media directory.
+// Live streams need RoleViewer, everything else (recordings, thumbnails) needs RoleReviewer.
+func (u *User) CanAccessMedia(mediaPath string) bool {
+	inputID, rest, _ := strings.Cut(mediaPath, "/")
+	if !u.CanAccessCamera(inputID) {
+		return false
+	}
+	if rest == "stream" || strings.HasPrefix(rest, "stream/") {
+		return u.HasRole(RoleViewer)
+	}
+	return u.HasRole(RoleReviewer)
+}
+
+type AuthConfig struct {
+	// Users are allowed to access the web UI and API.
+	// If empty, authentication is disabled and everything is public.
+	Users []User `json:"users"`
+	// SessionSecret is used to sign session cookies.
+	// If empty, a random secret is generated on boot and everybody is logged out on restart.
+	SessionSecret string `json:"session_secret"`
+	// SessionHours is how long a login lasts.
+	// Defaults to 168 (one week).
+	SessionHours int `json:"session_hours"`
+	// SecureCookies marks session cookies as HTTPS-only.
+	// Enable this if creamy-nvr is served over HTTPS.
+	SecureCookies bool `json:"secure_cookies"`
+}
+
+// Enabled returns true if authentication is required
+func (c AuthConfig) Enabled() bool {
+	return len(c.Users) > 0
+}
+
+// SessionDuration is SessionHours with the default applied
+func (c AuthConfig) SessionDuration() time.Duration {
+	if c.SessionHours <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(c.SessionHours) * time.Hour
+}
+
+const sessionCookieName = "creamy_nvr_session"
+
+// Authenticator checks session cookies and bearer tokens against the configured users
+type Authenticator struct {
+	config        AuthConfig
+	secret        []byte
+	usersByName   map[string]*User
+	usersByToken  map[[sha256.Size]byte]*User
+	dummyPassword []byte
+}
+
+func NewAuthenticator(config AuthConfig, inputs []Input) (*Authenticator, error) {
+	a := &Authenticator{
+		config:       config,
+		secret:       []byte(config.SessionSecret),
+		usersByName:  map[string]*User{},
+		usersByToken: map[[sha256.Size]byte]*User{},
+	}
+	if len(a.secret) == 0 {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, fmt.Errorf("failed to generate session secret: %v", err)
+		}
+	}
+
+	for i := range config.Users {
+		user := &config.Users[i]
+		if user.Username == "" {
+			return nil, fmt.Errorf("user %v has no username", i)
+		}
+		if _, ok := a.usersByName[user.Username]; ok {
+			return nil, fmt.Errorf("user %v is defined more than once", user.Username)
+		}
+		if user.EffectiveRole().level() == 0 {
+			return nil, fmt.Errorf("user %v has an unknown role %q, expected %q, %q or %q", user.Username, user.Role, RoleViewer, RoleReviewer, RoleAdmin)
+		}
+		for _, camera := range user.Cameras {
+			if !slices.ContainsFunc(inputs, func(input Input) bool { return input.ID == camera }) {
+				return nil, fmt.Errorf("user %v has access to camera %v, but no input has that ID", user.Username, camera)
+			}
+		}
+		if user.PasswordHash != "" {
+			if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+				return nil, fmt.Errorf("user %v has an invalid bcrypt password_hash: %v", user.Username, err)
+			}
+		}
+		a.usersByName[user.Username] = user
+		for _, tokenHash := range user.APITokenHashes {
+			decoded, err := hex.DecodeString(tokenHash)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, fmt.Errorf("user %v has an invalid api token hash, expected a hex-encoded SHA-256 hash", user.Username)
+			}
+			a.usersByToken[[sha256.Size]byte(decoded)] = user
+		}
+	}
+
+	// compared against when logging in as an unknown user, so that takes as long as a wrong password
+	dummyPassword, err := bcrypt.GenerateFromPassword(a.secret, bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate dummy password: %v", err)
+	}
+	a.dummyPassword = dummyPassword
+
+	return a, nil
+}
+
+// Login returns the user if the username and password are correct
+func (a *Authenticator) Login(username, password string) *User {
+	user, ok := a.usersByName[username]
+	if !ok || user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(a.dummyPassword, []byte(password))
+		return nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil
+	}
+	return user
+}
+
+// sessionSignature signs the username and expiry of a session.
+// The user's password hash is included so changing the password logs out existing sessions.
+func (a *Authenticator) sessionSignature(user *User, expiry int64) string {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%v\n%v\n%v", user.Username, expiry, user.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SessionCookie returns a cookie that authenticates as the given user until it expires
+func (a *Authenticator) SessionCookie(user *User) *http.Cookie {
+	expires := time.Now().Add(a.config.SessionDuration())
+	expiry := expires.Unix()
+	value := strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString([]byte(user.Username)),
+		strconv.FormatInt(expiry, 10),
+		a.sessionSignature(user, expiry),
+	}, ".")
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.config.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ClearSessionCookie returns a cookie that logs the browser out
+func (a *Authenticator) ClearSessionCookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.config.SecureCookies,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (a *Authenticator) userFromSession(value string) *User {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	username, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return nil
+	}
+	user, ok := a.usersByName[string(username)]
+	if !ok {
+		return nil
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sessionSignature(user, expiry))) {
+		return nil
+	}
+	return user
+}
+
+func (a *Authenticator) userFromToken(token string) *User {
+	hash := sha256.Sum256([]byte(token))
+	for tokenHash, user := range a.usersByToken {
+		if subtle.ConstantTimeCompare(hash[:], tokenHash[:]) == 1 {
+			return user
+		}
+	}
+	return nil
+}
+
+// Authenticate returns the user making the request, or nil if the request isn't authenticated
+func (a *Authenticator) Authenticate(r *http.Request) *User {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.userFromToken(strings.TrimSpace(token))
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return a.userFromSession(cookie.Value)
+	}
+	return nil
+}
+
+type userContextKey struct{}
+
+// anonymousAdmin is used for every request when authentication is disabled
+var anonymousAdmin = &User{Username: "anonymous", Role: RoleAdmin}
+
+// UserFromContext returns the user authenticated by Middleware
+func UserFromContext(ctx context.Context) *User {
+	user, _ := ctx.Value(userContextKey{}).(*User)
+	return user
+}
+
+// requiresAuth returns true for paths that expose camera data.
+// The UI bundle itself is public so the login page can load.
+func requiresAuth(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/login", "/api/me":
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/") ||
+		strings.HasPrefix(r.URL.Path, "/media/") ||
+		r.URL.Path == "/metrics"
+}
+
+// Middleware authenticates every request, rejecting unauthenticated requests to protected paths
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := anonymousAdmin
+		if a.config.Enabled() {
+			user = a.Authenticate(r)
+			if user == nil && requiresAuth(r) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="creamy-nvr"`)
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+type ApiV1Me struct {
+	Username      string   `json:"username,omitempty"`
+	AuthEnabled   bool     `json:"auth_enabled"`
+	Authenticated bool     `json:"authenticated"`
+	Role          Role     `json:"role,omitempty"`
+	Cameras       []string `json:"cameras,omitempty"`
+}
+
+func newApiV1Me(authEnabled bool, user *User) ApiV1Me {
+	me := ApiV1Me{AuthEnabled: authEnabled}
+	if user != nil {
+		me.Username = user.Username
+		me.Authenticated = true
+		me.Role = user.EffectiveRole()
+		me.Cameras = user.Cameras
+	}
+	return me
+}
+
+func (a *Authenticator) me(r *http.Request) ApiV1Me {
+	return newApiV1Me(a.config.Enabled(), UserFromContext(r.Context()))
+}
+
+// HandleLogin accepts a JSON or form-encoded username and password and sets a session cookie
+func (a *Authenticator) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&credentials); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	} else {
+		credentials.Username = r.PostFormValue("username")
+		credentials.Password = r.PostFormValue("password")
+	}
+
+	if !a.config.Enabled() {
+		writeJSON(w, a.me(r))
+		return
+	}
+
+	user := a.Login(credentials.Username, credentials.Password)
+	if user == nil {
+		logger.WithField("unit", "auth").WithField("username", credentials.Username).WithField("remote-addr", r.RemoteAddr).Warn("failed login")
+		writeJSONError(w, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+	http.SetCookie(w, a.SessionCookie(user))
+	writeJSON(w, newApiV1Me(true, user))
+}
+
+func (a *Authenticator) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, a.ClearSessionCookie())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Authenticator) HandleMe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.me(r))
+}
+
+// RequireRole rejects requests from users without the given role
+func RequireRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		if user == nil || !user.HasRole(role) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
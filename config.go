@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configPath is where the config is read from, unless CREAMY_NVR_CONFIG is set
+const configPath = "config.json"
+
+// configFromEnv returns true if the config comes from CREAMY_NVR_CONFIG instead of configPath
+func configFromEnv() bool {
+	return os.Getenv("CREAMY_NVR_CONFIG") != ""
+}
+
+// readConfig returns the raw config from CREAMY_NVR_CONFIG or configPath
+func readConfig() ([]byte, error) {
+	if env := os.Getenv("CREAMY_NVR_CONFIG"); env != "" {
+		return []byte(env), nil
+	}
+	return os.ReadFile(configPath)
+}
+
+// parseConfig unmarshals the config and checks everything needed to start recording
+func parseConfig(configBytes []byte) (Config, error) {
+	config := Config{}
+	if err := json.Unmarshal(configBytes, &config); err != nil {
+		return config, fmt.Errorf("failed to unmarshal config: %v", err)
+	}
+
+	if len(config.Inputs) == 0 {
+		return config, errors.New("must have at least one stream")
+	}
+
+	for _, input := range config.Inputs {
+		if err := input.validateMotionDetection(); err != nil {
+			return config, fmt.Errorf("stream %v has invalid motion detection config: %v", input.ID, err)
+		}
+	}
+	return config, nil
+}
+
+// validateConfig parses the config and also checks the parts that are otherwise only checked while booting,
+// without connecting to anything, so a replaced config doesn't stop creamy-nvr from starting again
+func validateConfig(configBytes []byte) error {
+	config, err := parseConfig(configBytes)
+	if err != nil {
+		return err
+	}
+	if _, err := NewAuthenticator(config.Auth, config.Inputs); err != nil {
+		return fmt.Errorf("invalid auth config: %v", err)
+	}
+	if _, err := NewWebhookDispatcher(config.Webhooks); err != nil {
+		return fmt.Errorf("invalid webhooks config: %v", err)
+	}
+	if config.MQTT.Enabled() && !strings.Contains(config.MQTT.Broker, "://") {
+		return errors.New("invalid mqtt config: mqtt broker must include a scheme, like tcp://mqtt.local:1883")
+	}
+	if _, err := NewAlerter(config.Alerts, config.Inputs, nil); err != nil {
+		return fmt.Errorf("invalid alerts config: %v", err)
+	}
+	if err := config.Listen.validate(); err != nil {
+		return fmt.Errorf("invalid listen config: %v", err)
+	}
+	return nil
+}
+
+// writeConfig replaces configPath, going through a temporary file so a crash never leaves half a config behind
+func writeConfig(configBytes []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// the config holds password hashes and secrets
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(configBytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
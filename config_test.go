@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"minimal", `{"inputs":[{"id":"cam","url":"rtsp://cam"}]}`, true},
+		{"not json", `{"inputs":`, false},
+		{"no streams", `{"inputs":[]}`, false},
+		{"unknown motion detector", `{"inputs":[{"id":"cam","motion_detection":{"detector":"magic"}}]}`, false},
+		{"user with unknown camera", `{"inputs":[{"id":"cam"}],"auth":{"users":[{"username":"a","cameras":["other"]}]}}`, false},
+		{"webhook without scheme", `{"inputs":[{"id":"cam"}],"webhooks":[{"url":"example.com"}]}`, false},
+		{"mqtt broker without scheme", `{"inputs":[{"id":"cam"}],"mqtt":{"broker":"mqtt.local:1883"}}`, false},
+		{"tls cert without key", `{"inputs":[{"id":"cam"}],"listen":{"tls_cert_file":"cert.pem"}}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateConfig([]byte(test.config)); (err == nil) != test.valid {
+				t.Errorf("got error %v, expected valid: %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	t.Chdir(t.TempDir())
+	t.Setenv("CREAMY_NVR_CONFIG", "")
+
+	for _, configBytes := range []string{`{"inputs":[{"id":"a"}]}`, `{"inputs":[{"id":"b"}]}`} {
+		if err := writeConfig([]byte(configBytes)); err != nil {
+			t.Fatal(err)
+		}
+		read, err := readConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(read) != configBytes {
+			t.Errorf("read %s, expected %s", read, configBytes)
+		}
+	}
+
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only %v to be left behind, got %v entries", configPath, len(entries))
+	}
+}
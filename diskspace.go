@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type DiskSpaceConfig struct {
+	// LowWaterBytes is the free space of the filesystem media/ is on below which pruning runs immediately,
+	// outside of Config.PruneIntervalMinutes, and every stream reports the "disk_full" check as failing.
+	// If 0, disabled.
+	LowWaterBytes int64 `json:"low_water_bytes"`
+	// LowWaterPercent is LowWaterBytes as a percentage of the filesystem.
+	// If 0, disabled.
+	// If both LowWaterBytes and LowWaterPercent are set, the larger mark is used.
+	LowWaterPercent float64 `json:"low_water_percent"`
+	// HighWaterBytes is the free space pruning makes room for once free space drops below the low-water mark,
+	// by deleting the oldest recordings of any input first, see Input.StoragePriority.
+	// If both HighWaterBytes and HighWaterPercent are 0, defaults to twice the low-water mark.
+	HighWaterBytes int64 `json:"high_water_bytes"`
+	// HighWaterPercent is HighWaterBytes as a percentage of the filesystem.
+	// If both HighWaterBytes and HighWaterPercent are set, the larger mark is used.
+	HighWaterPercent float64 `json:"high_water_percent"`
+	// CheckIntervalSeconds determines how often free space is checked.
+	// If 0, defaults to 30 seconds.
+	CheckIntervalSeconds int `json:"check_interval_seconds"`
+}
+
+// Enabled returns true if a low-water mark is configured
+func (c DiskSpaceConfig) Enabled() bool {
+	return c.LowWaterBytes > 0 || c.LowWaterPercent > 0
+}
+
+// CheckInterval is CheckIntervalSeconds with the default applied
+func (c DiskSpaceConfig) CheckInterval() time.Duration {
+	if c.CheckIntervalSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.CheckIntervalSeconds) * time.Second
+}
+
+// Watermarks returns the low-water and high-water marks in bytes for a filesystem of the given size.
+// The high-water mark is never below the low-water mark.
+func (c DiskSpaceConfig) Watermarks(total uint64) (int64, int64) {
+	mark := func(bytes int64, percent float64) int64 {
+		return max(bytes, int64(float64(total)*percent/100))
+	}
+	low := mark(c.LowWaterBytes, c.LowWaterPercent)
+	high := mark(c.HighWaterBytes, c.HighWaterPercent)
+	if high <= 0 {
+		high = 2 * low
+	}
+	return low, max(low, high)
+}
+
+// watchDiskSpace checks the free space of the filesystem media/ is on, pruning immediately when it drops below the low-water mark.
+// Streams report the "disk_full" check as failing for as long as free space stays below the mark.
+func watchDiskSpace(ctx context.Context, config *Config, streams []Stream, prune func()) {
+	logger := logger.WithField("unit", "disk-space")
+
+	setDiskFull := func(diskFull bool) {
+		for i := range streams {
+			stream := &streams[i]
+			previouslyFailing := stream.FailingChecks()
+			if stream.DiskFull.Load() == diskFull {
+				continue
+			}
+			stream.DiskFull.Store(diskFull)
+			publishCheckEvents(stream, previouslyFailing)
+		}
+	}
+
+	// check returns true if free space is below the low-water mark
+	check := func() (bool, error) {
+		total, free, err := filesystemSpace("media")
+		if err != nil {
+			return false, err
+		}
+		metrics.DiskFreeBytes.Store(int64(free))
+		low, _ := config.DiskSpace.Watermarks(total)
+		return int64(free) < low, nil
+	}
+
+	wasDiskFull := false
+	ticker := time.NewTicker(config.DiskSpace.CheckInterval())
+	defer ticker.Stop()
+	for {
+		diskFull, err := check()
+		if err != nil {
+			logger.WithError(err).Error("failed to check free disk space")
+		} else if diskFull {
+			if !wasDiskFull {
+				logger.Warn("free disk space is below the low-water mark, pruning")
+			}
+			setDiskFull(true)
+			prune()
+			if diskFull, err = check(); err != nil {
+				logger.WithError(err).Error("failed to check free disk space")
+			} else if diskFull {
+				logger.Warn("free disk space is still below the low-water mark after pruning")
+			}
+		}
+		if err == nil {
+			if wasDiskFull && !diskFull {
+				logger.Info("free disk space is above the low-water mark again")
+			}
+			setDiskFull(diskFull)
+			wasDiskFull = diskFull
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiskSpaceWatermarks(t *testing.T) {
+	tests := []struct {
+		name   string
+		config DiskSpaceConfig
+		total  uint64
+		low    int64
+		high   int64
+	}{
+		{"bytes", DiskSpaceConfig{LowWaterBytes: 100, HighWaterBytes: 300}, 1000, 100, 300},
+		{"high defaults to twice low", DiskSpaceConfig{LowWaterBytes: 100}, 1000, 100, 200},
+		{"percent", DiskSpaceConfig{LowWaterPercent: 5, HighWaterPercent: 10}, 1000, 50, 100},
+		{"larger mark wins", DiskSpaceConfig{LowWaterBytes: 100, LowWaterPercent: 5, HighWaterBytes: 50, HighWaterPercent: 30}, 1000, 100, 300},
+		{"high never below low", DiskSpaceConfig{LowWaterBytes: 100, HighWaterBytes: 50}, 1000, 100, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			low, high := test.config.Watermarks(test.total)
+			if low != test.low || high != test.high {
+				t.Errorf("got low %v high %v, expected low %v high %v", low, high, test.low, test.high)
+			}
+		})
+	}
+}
+
+func TestPlanWatermarks(t *testing.T) {
+	a := testRecording("cam", 3*time.Hour, 100)
+	b := testRecording("cam", 2*time.Hour, 100)
+	c := testRecording("cam", time.Hour, 100)
+	locked := testRecording("cam", 4*time.Hour, 100)
+	locked.Lock = &RecordingLock{ID: "lock"}
+
+	tests := []struct {
+		name       string
+		recordings []pruneItem
+		free       uint64
+		planned    []pruneDeletion
+		deleted    []string
+	}{
+		{
+			name:       "above low-water mark",
+			recordings: []pruneItem{a, b, c},
+			free:       100,
+			deleted:    []string{},
+		},
+		{
+			name:       "below low-water mark frees up to the high-water mark",
+			recordings: []pruneItem{a, b, c},
+			free:       50,
+			deleted:    []string{a.Path + " disk_space", b.Path + " disk_space"},
+		},
+		{
+			name:       "planned deletions count as free",
+			recordings: []pruneItem{b, c},
+			free:       50,
+			planned:    []pruneDeletion{{pruneItem: a, Reason: pruneReasonAge}},
+			deleted:    []string{a.Path + " age"},
+		},
+		{
+			name:       "locked recordings are kept",
+			recordings: []pruneItem{locked, a, b, c},
+			free:       50,
+			deleted:    []string{a.Path + " disk_space", b.Path + " disk_space"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Inputs:    []Input{{ID: "cam"}},
+				DiskSpace: DiskSpaceConfig{LowWaterBytes: 100, HighWaterBytes: 200},
+			}
+			plan := prunePlan{Deletions: test.planned}
+			planWatermarks(testLogger(), &plan, config, test.recordings, testNow, 1000, test.free)
+			if deleted := deletedPaths(plan); !slices.Equal(deleted, test.deleted) {
+				t.Errorf("deleted %v, expected %v", deleted, test.deleted)
+			}
+		})
+	}
+}
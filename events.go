@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published to the event bus
+const (
+	EventStreamActive        = "stream.active"
+	EventStreamInactive      = "stream.inactive"
+	EventStreamRestart       = "stream.restart"
+	EventStreamCheck         = "stream.check"
+	EventStreamOffline       = "stream.offline"
+	EventStreamOnline        = "stream.online"
+	EventStreamCrashLoop     = "stream.crashloop"
+	EventStreamRecovered     = "stream.recovered"
+	EventStreamPaused        = "stream.paused"
+	EventStreamResumed       = "stream.resumed"
+	EventRecordingNew        = "recording.new"
+	EventRecordingMotion     = "recording.motion"
+	EventRecordingThumbnail  = "recording.thumbnail"
+	EventRecordingPruned     = "recording.pruned"
+	EventMotionAlert         = "motion.alert"
+	EventMotionStart         = "motion.start"
+	EventMotionStop          = "motion.stop"
+	eventRecordingTypePrefix = "recording."
+	eventMotionTypePrefix    = "motion."
+)
+
+var eventTypes = []string{
+	EventStreamActive, EventStreamInactive, EventStreamRestart, EventStreamCheck,
+	EventStreamOffline, EventStreamOnline, EventStreamCrashLoop, EventStreamRecovered,
+	EventStreamPaused, EventStreamResumed,
+	EventRecordingNew, EventRecordingMotion, EventRecordingThumbnail, EventRecordingPruned,
+	EventMotionAlert, EventMotionStart, EventMotionStop,
+}
+
+type ApiV1EventCheck struct {
+	// Name is one of the names returned by Stream.FailingChecks
+	Name    string `json:"name"`
+	Failing bool   `json:"failing"`
+}
+
+type ApiV1Event struct {
+	ID       uint64    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	StreamID string    `json:"stream_id"`
+
+	// Stream is the state of the stream after the event, for stream.* events
+	Stream *ApiV1Stream `json:"stream,omitempty"`
+	// Check is the watchdog check that changed, for stream.check events
+	Check *ApiV1EventCheck `json:"check,omitempty"`
+	// Recording is the recording after the event, for recording.* and motion.* events
+	Recording *ApiV1Recording `json:"recording,omitempty"`
+	// Alert describes the motion that triggered a motion.alert event
+	Alert *ApiV1MotionAlert `json:"alert,omitempty"`
+	// LiveMotion describes the motion detected on the live stream, for motion.start and motion.stop events
+	LiveMotion *ApiV1LiveMotion `json:"live_motion,omitempty"`
+}
+
+// EventBus fans out events to every subscriber
+type EventBus struct {
+	lastID atomic.Uint64
+
+	lock        sync.Mutex
+	subscribers map[chan ApiV1Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: map[chan ApiV1Event]struct{}{},
+	}
+}
+
+// events are published throughout the application and streamed at /api/events
+var events = NewEventBus()
+
+// Publish sends the event to every subscriber without blocking.
+// Subscribers that have fallen too far behind are unsubscribed, closing their channel.
+func (b *EventBus) Publish(event ApiV1Event) {
+	event.ID = b.lastID.Add(1)
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			logger.WithField("unit", "events").WithField("event", event.Type).Warn("subscriber fell behind, dropping it")
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// and a function that must be called to unsubscribe.
+func (b *EventBus) Subscribe(buffer int) (<-chan ApiV1Event, func()) {
+	subscriber := make(chan ApiV1Event, buffer)
+	b.lock.Lock()
+	b.subscribers[subscriber] = struct{}{}
+	b.lock.Unlock()
+
+	return subscriber, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.subscribers[subscriber]; ok {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// publishStreamEvent publishes an event with the current state of the stream
+func publishStreamEvent(eventType string, stream *Stream) {
+	apiStream := newApiV1Stream(stream)
+	events.Publish(ApiV1Event{
+		Type:     eventType,
+		StreamID: stream.Input.ID,
+		Stream:   &apiStream,
+	})
+}
+
+// publishRecordingEvent publishes an event with the current state of the recording
+func publishRecordingEvent(eventType string, recording Recording, streamName string) {
+	apiRecording := newApiV1Recording(recording, streamName)
+	events.Publish(ApiV1Event{
+		Type:      eventType,
+		StreamID:  recording.InputID,
+		Recording: &apiRecording,
+	})
+}
+
+// canSeeEvent returns true if the user is allowed to see the event.
+// Recording and motion events need the same role as listing recordings.
+func canSeeEvent(user *User, event ApiV1Event) bool {
+	if !user.CanAccessCamera(event.StreamID) {
+		return false
+	}
+	if strings.HasPrefix(event.Type, eventRecordingTypePrefix) || strings.HasPrefix(event.Type, eventMotionTypePrefix) {
+		return user.HasRole(RoleReviewer)
+	}
+	return true
+}
+
+// serveEventStream streams events to the client as Server-Sent Events until the client disconnects or ctx is cancelled.
+// The stream_id and type query parameters (comma-separated or repeated) only include matching events.
+func serveEventStream(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	var streamIDs, types []string
+	for _, v := range r.URL.Query()["stream_id"] {
+		streamIDs = append(streamIDs, strings.Split(v, ",")...)
+	}
+	for _, v := range r.URL.Query()["type"] {
+		types = append(types, strings.Split(v, ",")...)
+	}
+	user := UserFromContext(r.Context())
+
+	subscription, unsubscribe := events.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// tell EventSource how long to wait before reconnecting
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event, ok := <-subscription:
+			if !ok {
+				// fell behind, the client will reconnect and should reload
+				return
+			}
+			if !canSeeEvent(user, event) {
+				continue
+			}
+			if len(streamIDs) > 0 && !slices.Contains(streamIDs, event.StreamID) {
+				continue
+			}
+			if len(types) > 0 && !slices.Contains(types, event.Type) {
+				continue
+			}
+			data, err := json.Marshal(&event)
+			if err != nil {
+				logger.WithField("unit", "events").WithError(err).Warn("failed to encode event")
+				continue
+			}
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The recording command is based on rtsp-to-hls.sh from https://github.com/w23/zenki
+// "WTFPL for the rest of this repo (or public domain if you're boring)."
+
+// StreamDirectory contains the HLS playlist of this stream.
+// It is 100% temporary and can be removed for cleaning.
+func (i Input) StreamDirectory() string {
+	return fmt.Sprintf("media/%v/stream", i.ID)
+}
+
+// StreamPlaylistPath is the HLS playlist of this stream
+func (i Input) StreamPlaylistPath() string {
+	return fmt.Sprintf("media/%v/stream/%v.m3u8", i.ID, i.ID)
+}
+
+// HLSTime is HLSTimeSeconds with the default applied
+func (i Input) HLSTime() int {
+	if i.HLSTimeSeconds <= 0 {
+		return 5
+	}
+	return i.HLSTimeSeconds
+}
+
+// HLSListLength is HLSListSize with the default applied
+func (i Input) HLSListLength() int {
+	if i.HLSListSize <= 0 {
+		return 360
+	}
+	return i.HLSListSize
+}
+
+// SegmentTime is SegmentTimeSeconds with the default applied
+func (i Input) SegmentTime() int {
+	if i.SegmentTimeSeconds <= 0 {
+		return 300
+	}
+	return i.SegmentTimeSeconds
+}
+
+// SegmentWrapCount is SegmentWrap with the default applied
+func (i Input) SegmentWrapCount() int {
+	if i.SegmentWrap <= 0 {
+		return 864
+	}
+	return i.SegmentWrap
+}
+
+// Transport is RTSPTransport with the default applied
+func (i Input) Transport() string {
+	if i.RTSPTransport == "" {
+		return "tcp"
+	}
+	return i.RTSPTransport
+}
+
+// isRTSP returns true if the stream URL uses RTSP, which -rtsp_transport applies to
+func isRTSP(streamURL string) bool {
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, "rtsp") || strings.EqualFold(u.Scheme, "rtsps")
+}
+
+// Codecs returns VideoCodec and AudioCodec with defaults applied
+func (i Input) Codecs() (string, string) {
+	videoCodec, audioCodec := i.VideoCodec, i.AudioCodec
+	if videoCodec == "" {
+		videoCodec = "copy"
+	}
+	if audioCodec == "" {
+		audioCodec = "copy"
+	}
+	return videoCodec, audioCodec
+}
+
+// prepareRecordingDirectories creates the directories ffmpeg writes to, since it doesn't create them itself,
+// and removes the playlist of the previous run
+func (i Input) prepareRecordingDirectories() error {
+	if err := os.MkdirAll(i.StreamSegmentDirectory(), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(i.RecordingDirectory(), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(i.StreamPlaylistPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ffmpegArgs builds the arguments of the stream-capturing command.
+// It writes a live HLS stream to StreamDirectory and archives segments to RecordingDirectory.
+func (i Input) ffmpegArgs() []string {
+	extraArgs := strings.Fields(i.ExtraFFMPEGArgs)
+	videoCodec, audioCodec := i.Codecs()
+
+	// loglevel level: prefix each line with its level, OpeningForWritingWriter depends on this
+	args := []string{"-loglevel", "level"}
+	if isRTSP(i.URL) {
+		// rtsp_transport: output is terrible for me using UDP
+		args = append(args, "-rtsp_transport", i.Transport())
+	}
+	// re: keep input framerate
+	args = append(args, "-re", "-i", i.URL)
+
+	// fps_mode passthrough: replaces -vsync 0
+	// movflags frag_keyframe+empty_moov: fragment output, place keyframes throughout instead of only at the end
+	// g 52: at least one keyframe every 52 frames
+	args = append(args, "-f", "hls")
+	args = append(args, extraArgs...)
+	args = append(
+		args,
+		"-fps_mode", "passthrough",
+		"-copyts", "-vcodec", videoCodec, "-acodec", audioCodec,
+		"-movflags", "frag_keyframe+empty_moov",
+		"-g", "52",
+		"-hls_flags", "delete_segments+append_list",
+		"-hls_time", strconv.Itoa(i.HLSTime()),
+		"-hls_list_size", strconv.Itoa(i.HLSListLength()),
+		"-hls_base_url", "segments/",
+		"-strftime", "1",
+		"-hls_segment_filename", fmt.Sprintf("%v/%v-%%06d-%%F-%%H-%%M-%%S.ts", i.StreamSegmentDirectory(), i.ID),
+		i.StreamPlaylistPath(),
+	)
+
+	// reset_timestamps 1: reset "length" for each segment, otherwise the second segment claims to have a length of 10 mins, the third a length of 15 mins, etc
+	args = append(args, "-f", "segment")
+	args = append(args, extraArgs...)
+	args = append(
+		args,
+		"-segment_time", strconv.Itoa(i.SegmentTime()),
+		"-segment_atclocktime", "1",
+		"-segment_wrap", strconv.Itoa(i.SegmentWrapCount()),
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		"-vcodec", videoCodec, "-acodec", audioCodec,
+		"-map", "0",
+		fmt.Sprintf("%v/%v-%%F-%%H-%%M-%%S.mp4", i.RecordingDirectory(), i.ID),
+	)
+
+	return args
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type ApiV1HealthCheck struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type ApiV1HealthStream struct {
+	ID              string   `json:"id"`
+	OK              bool     `json:"ok"`
+	Active          bool     `json:"active"`
+	FailingChecks   []string `json:"failing_checks"`
+	LastErrorReason string   `json:"last_error_reason,omitempty"`
+}
+
+type ApiV1Health struct {
+	Status  string                      `json:"status"`
+	Checks  map[string]ApiV1HealthCheck `json:"checks,omitempty"`
+	Streams []ApiV1HealthStream         `json:"streams,omitempty"`
+}
+
+// ReadyMinimumHealthyStreams is ReadyMinimumHealthyStreamFraction clamped to [0, 1]
+func (c *Config) ReadyMinimumHealthyStreams() float64 {
+	return math.Max(0, math.Min(1, c.ReadyMinimumHealthyStreamFraction))
+}
+
+// checkMediaWritable makes sure we can create files in the media directory,
+// without writing anything since readiness probes are unauthenticated and frequent
+func checkMediaWritable() error {
+	if err := os.MkdirAll("media", 0755); err != nil {
+		return err
+	}
+	if err := unix.Access("media", unix.W_OK|unix.X_OK); err != nil {
+		return fmt.Errorf("media is not writable: %v", err)
+	}
+	return nil
+}
+
+// readiness runs every readiness check and returns the result, and whether all checks passed
+func readiness(config *Config, streams []Stream, indexLoaded bool) (ApiV1Health, bool) {
+	health := ApiV1Health{
+		Checks:  map[string]ApiV1HealthCheck{},
+		Streams: make([]ApiV1HealthStream, len(streams)),
+	}
+
+	if indexLoaded {
+		health.Checks["index"] = ApiV1HealthCheck{OK: true}
+	} else {
+		health.Checks["index"] = ApiV1HealthCheck{Message: "recordings are still being loaded"}
+	}
+
+	for _, bin := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			health.Checks[bin] = ApiV1HealthCheck{Message: err.Error()}
+		} else {
+			health.Checks[bin] = ApiV1HealthCheck{OK: true}
+		}
+	}
+
+	if err := checkMediaWritable(); err != nil {
+		health.Checks["media_writable"] = ApiV1HealthCheck{Message: err.Error()}
+	} else {
+		health.Checks["media_writable"] = ApiV1HealthCheck{OK: true}
+	}
+
+	healthy := 0
+	for i := range streams {
+		failing := streams[i].FailingChecks()
+		health.Streams[i] = ApiV1HealthStream{
+			ID:              streams[i].Input.ID,
+			OK:              len(failing) == 0,
+			Active:          streams[i].Active.Load(),
+			FailingChecks:   failing,
+			LastErrorReason: streams[i].LastErrReason.Load(),
+		}
+		if len(failing) == 0 {
+			healthy++
+		}
+	}
+	minimum := config.ReadyMinimumHealthyStreams()
+	fraction := 1.0
+	if len(streams) > 0 {
+		fraction = float64(healthy) / float64(len(streams))
+	}
+	health.Checks["streams"] = ApiV1HealthCheck{
+		OK:      fraction >= minimum,
+		Message: fmt.Sprintf("%v of %v streams healthy, %.0f%% required", healthy, len(streams), minimum*100),
+	}
+
+	ok := true
+	for _, check := range health.Checks {
+		ok = ok && check.OK
+	}
+	if ok {
+		health.Status = "ok"
+	} else {
+		health.Status = "fail"
+	}
+	return health, ok
+}
+
+func writeHealth(w http.ResponseWriter, health ApiV1Health, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(&health)
+}
+
+// OfflineNotifyDelay is OfflineNotifySeconds with the default applied
+func (i Input) OfflineNotifyDelay() time.Duration {
+	if i.OfflineNotifySeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(i.OfflineNotifySeconds) * time.Second
+}
+
+// CrashLoopThreshold is CrashLoopFailures with the default applied
+func (i Input) CrashLoopThreshold() int {
+	if i.CrashLoopFailures <= 0 {
+		return 5
+	}
+	return i.CrashLoopFailures
+}
+
+// streamHealthState is what has been reported about a stream so far
+type streamHealthState struct {
+	unhealthySince time.Time
+	offline        bool
+	crashLooping   bool
+}
+
+// healthNotifier publishes events when streams go offline, come back online, start crash-looping, and recover.
+//
+// A stream is offline once it has been inactive or failing any check other than last_restart for OfflineNotifyDelay,
+// and back online once those checks pass again.
+// A stream is crash-looping once the stream-capturing command has stopped CrashLoopThreshold times in a row,
+// and recovered once every check passes, including having run for RestartErrThreshold.
+func healthNotifier(ctx context.Context, streams []Stream) {
+	states := make([]streamHealthState, len(streams))
+
+	check := func(i int) {
+		stream := &streams[i]
+		state := &states[i]
+		logger := logger.WithField("unit", "health").WithField("stream", stream.Input.ID)
+
+		failing := stream.FailingChecks()
+		unhealthy := slices.ContainsFunc(failing, func(check string) bool { return check != "last_restart" })
+
+		if !unhealthy {
+			state.unhealthySince = time.Time{}
+			if state.offline {
+				state.offline = false
+				logger.Info("stream is back online")
+				publishStreamEvent(EventStreamOnline, stream)
+			}
+		} else if state.unhealthySince.IsZero() {
+			state.unhealthySince = time.Now()
+		} else if !state.offline && time.Since(state.unhealthySince) >= stream.Input.OfflineNotifyDelay() {
+			state.offline = true
+			logger.WithField("failing-checks", failing).Warn("stream is offline")
+			publishStreamEvent(EventStreamOffline, stream)
+		}
+
+		if !state.crashLooping && stream.ConsecutiveFailures.Load() >= stream.Input.CrashLoopThreshold() {
+			state.crashLooping = true
+			logger.WithField("consecutive-failures", stream.ConsecutiveFailures.Load()).Warn("stream is crash-looping")
+			publishStreamEvent(EventStreamCrashLoop, stream)
+		} else if state.crashLooping && len(failing) == 0 {
+			state.crashLooping = false
+			logger.Info("stream has recovered")
+			publishStreamEvent(EventStreamRecovered, stream)
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for i := range streams {
+				check(i)
+			}
+		}
+	}
+}
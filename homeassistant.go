@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// haDevice groups every entity of a stream under one Home Assistant device
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+// haEntity is a Home Assistant MQTT discovery payload, see https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type haEntity struct {
+	Name             string           `json:"name"`
+	UniqueID         string           `json:"unique_id"`
+	Device           haDevice         `json:"device"`
+	Availability     []haAvailability `json:"availability"`
+	AvailabilityMode string           `json:"availability_mode,omitempty"`
+
+	StateTopic          string `json:"state_topic,omitempty"`
+	CommandTopic        string `json:"command_topic,omitempty"`
+	JSONAttributesTopic string `json:"json_attributes_topic,omitempty"`
+	// Topic is where a camera's images are published
+	Topic          string `json:"topic,omitempty"`
+	DeviceClass    string `json:"device_class,omitempty"`
+	EntityCategory string `json:"entity_category,omitempty"`
+	Icon           string `json:"icon,omitempty"`
+	OffDelay       int    `json:"off_delay,omitempty"`
+}
+
+var haInvalidNodeIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// publishHomeAssistantDiscovery publishes discovery payloads making the stream show up in Home Assistant as a device with
+// motion and problem binary_sensors, a last recording sensor, a camera showing the latest thumbnail,
+// a restart button and a recording switch.
+func publishHomeAssistantDiscovery(client *MQTTClient, stream *Stream) {
+	config := client.config
+	input := stream.Input
+	// the topic prefix is included so multiple instances don't clash
+	nodeID := haInvalidNodeIDChars.ReplaceAllString(config.Prefix()+"_"+input.ID, "_")
+
+	name := input.Name
+	if name == "" {
+		name = input.ID
+	}
+	device := haDevice{
+		Identifiers:  []string{nodeID},
+		Name:         name,
+		Manufacturer: "creamy-nvr",
+		Model:        "Camera",
+	}
+	bridgeAvailability := []haAvailability{{Topic: config.StatusTopic()}}
+	// entities that need the stream to be running are unavailable while it isn't
+	streamAvailability := []haAvailability{{Topic: config.StatusTopic()}, {Topic: config.Topic(input.ID, "availability")}}
+
+	// live motion turns the sensor off itself
+	motionOffDelay := int(config.MotionOffDelay().Seconds())
+	if input.LiveMotion.Enabled {
+		motionOffDelay = 0
+	}
+
+	entities := map[string]haEntity{
+		"binary_sensor/motion": {
+			Name:             "Motion",
+			Availability:     streamAvailability,
+			AvailabilityMode: "all",
+			StateTopic:       config.Topic(input.ID, "motion"),
+			DeviceClass:      "motion",
+			OffDelay:         motionOffDelay,
+		},
+		"binary_sensor/problem": {
+			Name:                "Problem",
+			Availability:        bridgeAvailability,
+			StateTopic:          config.Topic(input.ID, "problem"),
+			JSONAttributesTopic: config.Topic(input.ID, "state"),
+			DeviceClass:         "problem",
+			EntityCategory:      "diagnostic",
+		},
+		"sensor/last_recording": {
+			Name:           "Last recording",
+			Availability:   bridgeAvailability,
+			StateTopic:     config.Topic(input.ID, "last_recording"),
+			DeviceClass:    "timestamp",
+			EntityCategory: "diagnostic",
+		},
+		"camera/thumbnail": {
+			Name:             "Thumbnail",
+			Availability:     streamAvailability,
+			AvailabilityMode: "all",
+			Topic:            config.Topic(input.ID, "thumbnail"),
+		},
+		"button/restart": {
+			Name:           "Restart",
+			Availability:   bridgeAvailability,
+			CommandTopic:   config.Topic(input.ID, "restart"),
+			DeviceClass:    "restart",
+			EntityCategory: "config",
+		},
+		"switch/recording": {
+			Name:         "Recording",
+			Availability: bridgeAvailability,
+			StateTopic:   config.Topic(input.ID, "recording"),
+			CommandTopic: config.Topic(input.ID, "recording", "set"),
+			Icon:         "mdi:record-rec",
+		},
+	}
+
+	for key, entity := range entities {
+		component, object, _ := strings.Cut(key, "/")
+		entity.UniqueID = nodeID + "_" + object
+		entity.Device = device
+		payload, err := json.Marshal(&entity)
+		if err != nil {
+			logger.WithField("unit", "mqtt").WithError(err).Warn("failed to encode discovery payload")
+			continue
+		}
+		client.Publish(config.HomeAssistantPrefix()+"/"+component+"/"+nodeID+"/"+object+"/config", true, payload)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// IndexPath is where the recording index is persisted
+const IndexPath = "media/index.db"
+
+var (
+	bucketRecordings   = []byte("recordings")
+	bucketClipFailures = []byte("clip_failures")
+)
+
+// RecordingIndex is an on-disk store of Recording metadata, keyed by recording path.
+// It lets us skip calling ffprobe and performing motion detection on every recording at boot.
+type RecordingIndex struct {
+	db *bbolt.DB
+}
+
+// OpenRecordingIndexReadOnly opens an existing index without changing it.
+// This fails while the index is open elsewhere, like in a running server.
+func OpenRecordingIndexReadOnly(fpath string) (*RecordingIndex, error) {
+	db, err := bbolt.Open(fpath, 0600, &bbolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %v: %v", fpath, err)
+	}
+	return &RecordingIndex{db: db}, nil
+}
+
+func OpenRecordingIndex(fpath string) (*RecordingIndex, error) {
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %v", err)
+	}
+	db, err := bbolt.Open(fpath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %v: %v", fpath, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{bucketRecordings, bucketLocks, bucketClipFailures} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize index %v: %v", fpath, err)
+	}
+	return &RecordingIndex{db: db}, nil
+}
+
+// Put inserts or replaces the recording stored at recording.Path
+func (idx *RecordingIndex) Put(recording Recording) error {
+	data, err := json.Marshal(&recording)
+	if err != nil {
+		return err
+	}
+	return idx.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRecordings).Put([]byte(recording.Path), data)
+	})
+}
+
+// Delete removes the recording stored at fpath, if any, along with its clip failures
+func (idx *RecordingIndex) Delete(fpath string) error {
+	return idx.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketClipFailures).Delete([]byte(fpath)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketRecordings).Delete([]byte(fpath))
+	})
+}
+
+// AddClipFailure counts a failed attempt at cutting clips from the recording at fpath, see maxClipAttempts
+func (idx *RecordingIndex) AddClipFailure(fpath string) error {
+	return idx.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketClipFailures)
+		failures, _ := strconv.Atoi(string(bucket.Get([]byte(fpath))))
+		return bucket.Put([]byte(fpath), []byte(strconv.Itoa(failures+1)))
+	})
+}
+
+// ClipFailures returns how many attempts at cutting clips failed, keyed by recording path
+func (idx *RecordingIndex) ClipFailures() (map[string]int, error) {
+	failures := map[string]int{}
+	err := idx.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketClipFailures)
+		if bucket == nil {
+			// indexes opened read-only from before clip failures were counted
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("failed to parse clip failures of %v: %v", string(k), err)
+			}
+			failures[string(k)] = n
+			return nil
+		})
+	})
+	return failures, err
+}
+
+// All returns every indexed recording, keyed by path
+func (idx *RecordingIndex) All() (map[string]Recording, error) {
+	recordings := map[string]Recording{}
+	err := idx.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketRecordings).ForEach(func(k, v []byte) error {
+			var recording Recording
+			if err := json.Unmarshal(v, &recording); err != nil {
+				return fmt.Errorf("failed to parse indexed recording %v: %v", string(k), err)
+			}
+			recordings[string(k)] = recording
+			return nil
+		})
+	})
+	return recordings, err
+}
+
+func (idx *RecordingIndex) Close() error {
+	return idx.db.Close()
+}
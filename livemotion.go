@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"maps"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// liveMotionAlgorithm is the name recorded for motion detected by LiveMotionDetector
+	liveMotionAlgorithm = "live-pixeldiff"
+	// liveMotionAlgorithmVersion should be bumped whenever LiveMotionDetector scores change for the same frames
+	liveMotionAlgorithmVersion = 1
+)
+
+// liveMotionInfo describes motion detected by LiveMotionDetector, see MotionDetectorInfo
+func (i Input) liveMotionInfo() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        liveMotionAlgorithm,
+		AlgorithmVersion: liveMotionAlgorithmVersion,
+		MinimumScore:     i.PixelDiff.MinScore(),
+		Params:           pixelDiffParams(i.PixelDiff, i.MotionZones),
+	}
+}
+
+type LiveMotionConfig struct {
+	// Enabled continuously decodes a low-resolution copy of the stream to detect motion within seconds,
+	// instead of decoding each recording after it closes
+	Enabled bool `json:"enabled"`
+	// URL is the stream to decode, like a low-resolution sub-stream of the camera.
+	// Defaults to the input's URL.
+	URL string `json:"url"`
+	// StopAfterSeconds is how long there must be no motion before a motion event stops.
+	// Defaults to 10.
+	StopAfterSeconds int `json:"stop_after_seconds"`
+}
+
+// StopAfter is StopAfterSeconds with the default applied
+func (c LiveMotionConfig) StopAfter() time.Duration {
+	if c.StopAfterSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.StopAfterSeconds) * time.Second
+}
+
+// ffmpegArgs builds the arguments of the command decoding scaled grayscale frames to stdout
+func (c LiveMotionConfig) ffmpegArgs(input Input) []string {
+	url := c.URL
+	if url == "" {
+		url = input.URL
+	}
+
+	args := []string{"-loglevel", "error"}
+	if isRTSP(url) {
+		args = append(args, "-rtsp_transport", input.Transport())
+	}
+	return append(
+		args,
+		"-i", url,
+		"-an",
+		"-vf", input.PixelDiff.filter(),
+		"-f", "rawvideo",
+		"-pix_fmt", "gray",
+		"pipe:1",
+	)
+}
+
+// liveMotionSample is the highest frame score of one second
+type liveMotionSample struct {
+	Time time.Time
+	peakScore
+}
+
+// ApiV1LiveMotion describes a motion event detected on the live stream
+type ApiV1LiveMotion struct {
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end,omitempty"`
+	PeakTime  time.Time  `json:"peak_time"`
+	PeakScore int        `json:"peak_score"`
+	// PeakZones is the highest score of each motion zone during the event
+	PeakZones map[string]int `json:"peak_zones,omitempty"`
+}
+
+// LiveMotionDetector scores the live stream every second, publishing motion.start and motion.stop events,
+// and keeps recent scores so they can be saved with recordings once they close
+type LiveMotionDetector struct {
+	stream   *Stream
+	config   LiveMotionConfig
+	minScore int
+
+	// Moving is true between motion.start and motion.stop
+	Moving AValue[bool]
+
+	lock    sync.Mutex
+	samples []liveMotionSample
+	current ApiV1LiveMotion
+}
+
+func NewLiveMotionDetector(stream *Stream) *LiveMotionDetector {
+	return &LiveMotionDetector{
+		stream:   stream,
+		config:   stream.Input.LiveMotion,
+		minScore: stream.Input.PixelDiff.MinScore(),
+	}
+}
+
+// retention is how long samples are kept, long enough to cover a recording that is still being closed
+func (d *LiveMotionDetector) retention() time.Duration {
+	return 3 * time.Duration(d.stream.Input.SegmentTime()) * time.Second
+}
+
+// addSample records the score of a second, starting or stopping motion events
+func (d *LiveMotionDetector) addSample(sample liveMotionSample) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.samples = append(d.samples, sample)
+	cutoff := sample.Time.Add(-d.retention())
+	for len(d.samples) > 0 && d.samples[0].Time.Before(cutoff) {
+		d.samples = d.samples[1:]
+	}
+
+	if sample.Score >= d.minScore {
+		if !d.Moving.Load() {
+			d.current = ApiV1LiveMotion{Start: sample.Time}
+			d.Moving.Store(true)
+			d.current.PeakTime, d.current.PeakScore = sample.Time, sample.Score
+			d.current.PeakZones = maps.Clone(sample.Zones)
+			d.publish(EventMotionStart)
+		} else {
+			if sample.Score > d.current.PeakScore {
+				d.current.PeakTime, d.current.PeakScore = sample.Time, sample.Score
+			}
+			for name, score := range sample.Zones {
+				if d.current.PeakZones == nil {
+					d.current.PeakZones = map[string]int{}
+				}
+				d.current.PeakZones[name] = max(d.current.PeakZones[name], score)
+			}
+		}
+		d.current.End = &sample.Time
+	} else if d.Moving.Load() && sample.Time.Sub(*d.current.End) >= d.config.StopAfter() {
+		d.stop()
+	}
+}
+
+// stop ends the current motion event. d.lock must be held.
+func (d *LiveMotionDetector) stop() {
+	if !d.Moving.Load() {
+		return
+	}
+	d.Moving.Store(false)
+	d.publish(EventMotionStop)
+}
+
+func (d *LiveMotionDetector) publish(eventType string) {
+	motion := d.current
+	motion.PeakZones = maps.Clone(motion.PeakZones)
+	if eventType == EventMotionStart {
+		motion.End = nil
+	}
+	logger.WithField("unit", "live-motion").WithField("stream", d.stream.Input.ID).WithField("event", eventType).WithField("peak-score", motion.PeakScore).Info("live motion")
+	events.Publish(ApiV1Event{
+		Type:       eventType,
+		StreamID:   d.stream.Input.ID,
+		LiveMotion: &motion,
+	})
+}
+
+// Timeline returns the motion between from and to, in seconds since from,
+// and false if the live stream wasn't scored for most of that time
+func (d *LiveMotionDetector) Timeline(from, to time.Time) ([]motion, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ms := []motion{}
+	scored := 0
+	start := from.Truncate(time.Second)
+	for _, sample := range d.samples {
+		if sample.Time.Before(start) || !sample.Time.Before(to) {
+			continue
+		}
+		scored++
+		if sample.Score >= d.minScore {
+			ms = append(ms, motion{Time: int(sample.Time.Sub(start) / time.Second), Score: min(sample.Score, 100), Zones: sample.Zones})
+		}
+	}
+	return ms, float64(scored) >= 0.9*to.Sub(from).Seconds()
+}
+
+// run decodes the live stream until it ends, ctx is cancelled, or recording is paused
+func (d *LiveMotionDetector) run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	scorer, err := newPixelDiffScorer(d.stream.Input.PixelDiff, d.stream.Input.MotionZones)
+	if err != nil {
+		return err
+	}
+	width, height := d.stream.Input.PixelDiff.FrameSize()
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", d.config.ffmpegArgs(d.stream.Input)...)
+	cmd.Stderr = logger.WithField("unit", "live-motion").WithField("stream", d.stream.Input.ID).WriterLevel(logrus.WarnLevel)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// stop ffmpeg before waiting for it, it would block writing to stdout once we stop reading
+	defer func() {
+		cancel()
+		cmd.Wait()
+	}()
+
+	reader := bufio.NewReaderSize(stdout, width*height)
+	previous, current := make([]byte, width*height), make([]byte, width*height)
+	if _, err := io.ReadFull(reader, previous); err != nil {
+		return err
+	}
+	second := time.Now().Truncate(time.Second)
+	peak := peakScore{}
+	for {
+		if _, err := io.ReadFull(reader, current); err != nil {
+			return err
+		}
+		now := time.Now().Truncate(time.Second)
+		if !now.Equal(second) {
+			d.addSample(liveMotionSample{Time: second, peakScore: peak})
+			second, peak = now, peakScore{}
+			if d.stream.Paused.Load() {
+				return nil
+			}
+		}
+		peak.add(scorer.score(previous, current))
+		previous, current = current, previous
+	}
+}
+
+// Run scores the live stream until ctx is cancelled, restarting the decoder whenever it stops.
+// Nothing is decoded while recording is paused.
+func (d *LiveMotionDetector) Run(ctx context.Context) {
+	logger := logger.WithField("unit", "live-motion").WithField("stream", d.stream.Input.ID)
+	for {
+		if !d.stream.Paused.Load() {
+			err := d.run(ctx)
+			d.lock.Lock()
+			d.stop()
+			d.lock.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil && err != io.EOF {
+				logger.WithError(err).Warn("live motion detection stopped, restarting")
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
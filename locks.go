@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+var bucketLocks = []byte("locks")
+
+// RecordingLock protects a recording, or every recording of a stream overlapping a time range, from pruning
+type RecordingLock struct {
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+	// RecordingID locks a single recording, if set
+	RecordingID string `json:"recording_id,omitempty"`
+	// Start and End lock every recording of the stream overlapping this time range, if RecordingID isn't set
+	Start time.Time `json:"start,omitzero"`
+	End   time.Time `json:"end,omitzero"`
+	// Reason is why the recordings are kept, like an incident number
+	Reason string `json:"reason,omitempty"`
+	// Expires is when the lock stops protecting recordings.
+	// If zero, the lock never expires and must be removed by hand.
+	Expires   time.Time `json:"expires,omitzero"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Expired returns true if the lock no longer protects recordings
+func (l RecordingLock) Expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// Covers returns true if the lock protects the stream's recording spanning start to end
+func (l RecordingLock) Covers(streamID, recordingID string, start, end time.Time) bool {
+	if l.StreamID != streamID {
+		return false
+	}
+	if l.RecordingID != "" {
+		return l.RecordingID == recordingID
+	}
+	return start.Before(l.End) && end.After(l.Start)
+}
+
+// validate checks the lock targets a recording or a time range and hasn't already expired
+func (l RecordingLock) validate(now time.Time) error {
+	if l.StreamID == "" {
+		return errors.New("stream_id is required")
+	}
+	if l.RecordingID == "" {
+		if l.Start.IsZero() || l.End.IsZero() {
+			return errors.New("either recording_id or start and end are required")
+		}
+		if !l.Start.Before(l.End) {
+			return errors.New("start must be before end")
+		}
+	} else if !l.Start.IsZero() || !l.End.IsZero() {
+		return errors.New("recording_id can't be combined with start and end")
+	}
+	if l.Expired(now) {
+		return errors.New("expires must be in the future")
+	}
+	return nil
+}
+
+// findLock returns the first unexpired lock protecting the stream's recording spanning start to end, or nil
+func findLock(locks []RecordingLock, streamID, recordingID string, start, end, now time.Time) *RecordingLock {
+	for i := range locks {
+		if !locks[i].Expired(now) && locks[i].Covers(streamID, recordingID, start, end) {
+			return &locks[i]
+		}
+	}
+	return nil
+}
+
+// recordingLock returns the unexpired lock protecting the recording, or nil.
+// Recordings that haven't been probed yet are assumed to last a whole segment.
+func recordingLock(locks []RecordingLock, input Input, recording Recording, now time.Time) *RecordingLock {
+	end := recording.End
+	if !end.After(recording.Start) {
+		end = recording.Start.Add(time.Duration(input.SegmentTime()) * time.Second)
+	}
+	return findLock(locks, recording.InputID, recording.ID, recording.Start, end, now)
+}
+
+func newLockID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// PutLock inserts or replaces the lock stored at lock.ID
+func (idx *RecordingIndex) PutLock(lock RecordingLock) error {
+	data, err := json.Marshal(&lock)
+	if err != nil {
+		return err
+	}
+	return idx.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketLocks).Put([]byte(lock.ID), data)
+	})
+}
+
+// DeleteLock removes the lock stored at id, if any
+func (idx *RecordingIndex) DeleteLock(id string) error {
+	return idx.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucketLocks).Delete([]byte(id))
+	})
+}
+
+// Locks returns every stored lock, oldest first
+func (idx *RecordingIndex) Locks() ([]RecordingLock, error) {
+	locks := []RecordingLock{}
+	err := idx.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketLocks)
+		if bucket == nil {
+			// indexes opened read-only from before locks existed
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var lock RecordingLock
+			if err := json.Unmarshal(v, &lock); err != nil {
+				return fmt.Errorf("failed to parse lock %v: %v", string(k), err)
+			}
+			locks = append(locks, lock)
+			return nil
+		})
+	})
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].Created.Before(locks[j].Created)
+	})
+	return locks, err
+}
+
+// DeleteExpiredLocks removes every lock that has expired, returning how many were removed
+func (idx *RecordingIndex) DeleteExpiredLocks(now time.Time) (int, error) {
+	removed := 0
+	err := idx.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(bucketLocks)
+		expired := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			var lock RecordingLock
+			if err := json.Unmarshal(v, &lock); err != nil {
+				return fmt.Errorf("failed to parse lock %v: %v", string(k), err)
+			}
+			if lock.Expired(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordingLockCovers(t *testing.T) {
+	start := testNow.Add(-2 * time.Hour)
+	end := testNow.Add(-time.Hour)
+	rangeLock := RecordingLock{StreamID: "cam", Start: start, End: end}
+	recordingLock := RecordingLock{StreamID: "cam", RecordingID: "cam-1.mp4"}
+
+	tests := []struct {
+		name        string
+		lock        RecordingLock
+		streamID    string
+		recordingID string
+		start, end  time.Time
+		covers      bool
+	}{
+		{"recording", recordingLock, "cam", "cam-1.mp4", start, end, true},
+		{"other recording", recordingLock, "cam", "cam-2.mp4", start, end, false},
+		{"other stream", recordingLock, "other", "cam-1.mp4", start, end, false},
+		{"inside range", rangeLock, "cam", "x.mp4", start.Add(time.Minute), end.Add(-time.Minute), true},
+		{"overlaps start", rangeLock, "cam", "x.mp4", start.Add(-time.Minute), start.Add(time.Minute), true},
+		{"overlaps end", rangeLock, "cam", "x.mp4", end.Add(-time.Minute), end.Add(time.Minute), true},
+		{"spans range", rangeLock, "cam", "x.mp4", start.Add(-time.Minute), end.Add(time.Minute), true},
+		{"ends at start", rangeLock, "cam", "x.mp4", start.Add(-time.Minute), start, false},
+		{"starts at end", rangeLock, "cam", "x.mp4", end, end.Add(time.Minute), false},
+		{"range of other stream", rangeLock, "other", "x.mp4", start, end, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if covers := test.lock.Covers(test.streamID, test.recordingID, test.start, test.end); covers != test.covers {
+				t.Errorf("got %v, expected %v", covers, test.covers)
+			}
+		})
+	}
+}
+
+func TestRecordingLockExpired(t *testing.T) {
+	tests := []struct {
+		name    string
+		expires time.Time
+		expired bool
+	}{
+		{"never", time.Time{}, false},
+		{"future", testNow.Add(time.Second), false},
+		{"now", testNow, true},
+		{"past", testNow.Add(-time.Second), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if expired := (RecordingLock{Expires: test.expires}).Expired(testNow); expired != test.expired {
+				t.Errorf("got %v, expected %v", expired, test.expired)
+			}
+		})
+	}
+}
+
+func TestRecordingLockValidate(t *testing.T) {
+	start := testNow.Add(-2 * time.Hour)
+	end := testNow.Add(-time.Hour)
+	tests := []struct {
+		name  string
+		lock  RecordingLock
+		valid bool
+	}{
+		{"recording", RecordingLock{StreamID: "cam", RecordingID: "cam-1.mp4"}, true},
+		{"range", RecordingLock{StreamID: "cam", Start: start, End: end}, true},
+		{"missing stream", RecordingLock{RecordingID: "cam-1.mp4"}, false},
+		{"missing target", RecordingLock{StreamID: "cam"}, false},
+		{"missing end", RecordingLock{StreamID: "cam", Start: start}, false},
+		{"reversed range", RecordingLock{StreamID: "cam", Start: end, End: start}, false},
+		{"recording and range", RecordingLock{StreamID: "cam", RecordingID: "cam-1.mp4", Start: start, End: end}, false},
+		{"already expired", RecordingLock{StreamID: "cam", RecordingID: "cam-1.mp4", Expires: testNow}, false},
+		{"expires later", RecordingLock{StreamID: "cam", RecordingID: "cam-1.mp4", Expires: testNow.Add(time.Hour)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.lock.validate(testNow); (err == nil) != test.valid {
+				t.Errorf("got error %v, expected valid: %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestFindLock(t *testing.T) {
+	input := Input{ID: "cam", SegmentTimeSeconds: 600}
+	recording := Recording{ID: "cam-1.mp4", InputID: "cam", Start: testNow.Add(-time.Hour)}
+	locks := []RecordingLock{
+		{ID: "expired", StreamID: "cam", RecordingID: "cam-1.mp4", Expires: testNow.Add(-time.Minute)},
+		// only covers the recording if it's assumed to last a whole segment
+		{ID: "range", StreamID: "cam", Start: testNow.Add(-55 * time.Minute), End: testNow},
+	}
+
+	lock := recordingLock(locks, input, recording, testNow)
+	if lock == nil || lock.ID != "range" {
+		t.Errorf("unprobed recording got lock %+v, expected range", lock)
+	}
+
+	recording.End = recording.Start.Add(time.Minute)
+	if lock := recordingLock(locks, input, recording, testNow); lock != nil {
+		t.Errorf("probed recording got lock %+v, expected none", lock)
+	}
+
+	if lock := findLock(locks[:1], "cam", "cam-1.mp4", recording.Start, recording.End, testNow.Add(-2*time.Minute)); lock == nil {
+		t.Errorf("lock expired before it expires")
+	}
+}
+
+func TestIndexLocks(t *testing.T) {
+	index, err := OpenRecordingIndex(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	locks := []RecordingLock{
+		{ID: "a", StreamID: "cam", RecordingID: "cam-1.mp4", Created: testNow.Add(-2 * time.Hour), Expires: testNow.Add(-time.Minute)},
+		{ID: "b", StreamID: "cam", RecordingID: "cam-2.mp4", Created: testNow.Add(-time.Hour)},
+	}
+	for _, lock := range locks {
+		if err := index.PutLock(lock); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := index.DeleteExpiredLocks(testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Errorf("removed %v expired locks, expected 1", removed)
+	}
+	stored, err := index.Locks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].ID != "b" {
+		t.Errorf("got locks %+v, expected only b", stored)
+	}
+
+	if err := index.DeleteLock("b"); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err = index.Locks(); err != nil || len(stored) != 0 {
+		t.Errorf("got locks %+v and error %v after deleting every lock", stored, err)
+	}
+}
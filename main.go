@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"embed"
@@ -14,6 +13,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -21,15 +21,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-//go:embed rtsp-to-hls.sh
-var script []byte
-
 //go:embed ui/dist
 var ui embed.FS
 
@@ -45,12 +43,72 @@ type Input struct {
 	// As an example, specify `"extra_ffmpeg_args": "-tag:v hvc1"` to make your hev1 cameras playable on iOS
 	ExtraFFMPEGArgs string `json:"extra_ffmpeg_args"`
 
+	// RTSPTransport is the lower transport protocol used for RTSP URLs, like "tcp" or "udp".
+	// Defaults to "tcp".
+	RTSPTransport string `json:"rtsp_transport"`
+
+	// VideoCodec is the ffmpeg video codec used for the live stream and recordings.
+	// Defaults to "copy", which saves the camera's stream as-is.
+	// Set to something like "libx264" to transcode.
+	VideoCodec string `json:"video_codec"`
+	// AudioCodec is the ffmpeg audio codec used for the live stream and recordings.
+	// Defaults to "copy".
+	AudioCodec string `json:"audio_codec"`
+
+	// HLSTimeSeconds is the length of each live stream chunk.
+	// This is the inherent delay of the live stream.
+	// Defaults to 5.
+	HLSTimeSeconds int `json:"hls_time_seconds"`
+	// HLSListSize is the amount of live stream chunks kept in the playlist.
+	// Defaults to 360 (30 minutes of 5 second chunks).
+	HLSListSize int `json:"hls_list_size"`
+	// SegmentTimeSeconds is the length of each recording.
+	// Defaults to 300 (5 minutes).
+	SegmentTimeSeconds int `json:"segment_time_seconds"`
+	// SegmentWrap is the amount of recordings kept before ffmpeg starts overwriting them.
+	// Defaults to 864 (3 days of 5 minute recordings).
+	SegmentWrap int `json:"segment_wrap"`
+
+	// RestartBackoffInitialSeconds is how long to wait before restarting the stream-capturing command after it first stops.
+	// Defaults to 5.
+	RestartBackoffInitialSeconds int `json:"restart_backoff_initial_seconds"`
+	// RestartBackoffMaxSeconds is the longest we'll wait before restarting the stream-capturing command.
+	// Defaults to 300.
+	RestartBackoffMaxSeconds int `json:"restart_backoff_max_seconds"`
+	// RestartBackoffMultiplier is applied to the restart delay after each consecutive failure.
+	// The delay resets after the command records for at least a minute.
+	// Defaults to 2.
+	RestartBackoffMultiplier float64 `json:"restart_backoff_multiplier"`
+	// RestartBackoffJitter randomly varies each restart delay by up to this fraction, so cameras on the same network don't restart in lockstep.
+	// Defaults to 0.2 (+/- 20%). Set to -1 to disable.
+	RestartBackoffJitter float64 `json:"restart_backoff_jitter"`
+
+	// RestartErrThresholdSeconds is how long after a restart the stream is considered to be possibly crashlooping.
+	// Defaults to 300.
+	RestartErrThresholdSeconds int `json:"restart_err_threshold_seconds"`
+	// FileOpenedErrThresholdSeconds is how long ffmpeg can go without opening a file before the stream is restarted.
+	// Defaults to 180, or three times HLSTimeSeconds if that is longer.
+	FileOpenedErrThresholdSeconds int `json:"file_opened_err_threshold_seconds"`
+	// SegmentOpenedErrThresholdSeconds is how long ffmpeg can go without opening a recording before the stream is restarted.
+	// Defaults to three times SegmentTimeSeconds.
+	SegmentOpenedErrThresholdSeconds int `json:"segment_opened_err_threshold_seconds"`
+	// StallThresholdSeconds is how long the live stream playlist or the current recording can go without being written to before the stream is restarted.
+	// Defaults to 60, or six times HLSTimeSeconds if that is longer.
+	StallThresholdSeconds int `json:"stall_threshold_seconds"`
+	// OfflineNotifySeconds is how long the stream must be failing health checks before it is reported offline.
+	// Defaults to 60.
+	OfflineNotifySeconds int `json:"offline_notify_seconds"`
+	// CrashLoopFailures is how many times in a row the stream-capturing command must stop before the stream is reported as crash-looping.
+	// Defaults to 5.
+	CrashLoopFailures int `json:"crash_loop_failures"`
+
 	// RecordingAgeLimitHours is the amount of hours of recordings to keep.
 	// If 0, disabled.
 	// If 1, keep recordings from the last 60 minutes.
 	// If 2, keep recordings from the last 120 minutes, etc.
 	// Pruning may be performed on an interval.
 	// Recordings older than this age may be kept until pruning occurs.
+	// See MotionRetention to keep recordings with motion for longer.
 	RecordingAgeLimitHours int `json:"recording_age_limit_hours"`
 
 	// RecordingSizeLimitMegabytes is the amount of megabytes of recordings to keep.
@@ -70,12 +128,54 @@ type Input struct {
 	// See RecordingSizeLimitMegabytes
 	StreamSizeLimitMegabytes int `json:"stream_size_limit_megabytes"`
 
-	// MotionDetectionMinimumScore is the minimum ffmpeg scdet score required
+	// StoragePriority weights the age of this stream's recordings when enforcing Config.StorageBudget.
+	// If 0 or 1, recordings are deleted oldest first with every other stream's.
+	// If 2, recordings are kept twice as long as those of streams with priority 1, etc.
+	StoragePriority int `json:"storage_priority"`
+
+	// StorageMinimumRetentionHours is the amount of hours of recordings Config.StorageBudget never deletes.
+	// If 0, disabled.
+	// Age and size limits of this stream still apply.
+	StorageMinimumRetentionHours int `json:"storage_minimum_retention_hours"`
+
+	// MotionDetectionMinimumScore is the minimum score required
 	// for a motion entry to appear in the recording's motion detection list.
+	// Used by the mpdecimate, scene and command detectors, see PixelDiff for pixeldiff.
 	// Defaults to 10.
 	// Raise this if you get way too many false positives.
 	// Set to -1 if you want to include every single event.
 	MotionDetectionMinimumScore int `json:"motion_detection_minimum_score"`
+
+	// MotionDetection selects and tunes the algorithm detecting motion in recordings
+	MotionDetection MotionDetectionConfig `json:"motion_detection"`
+
+	// MotionZones limit motion detection to parts of the frame, or ignore parts of it.
+	// Only supported by the pixeldiff detector, which is the default for inputs with motion zones.
+	MotionZones []MotionZone `json:"motion_zones"`
+
+	// PixelDiff tunes live motion detection and the pixeldiff detector
+	PixelDiff PixelDiffConfig `json:"pixel_diff"`
+
+	// LiveMotion detects motion on the live stream within seconds, instead of after each recording closes
+	LiveMotion LiveMotionConfig `json:"live_motion"`
+
+	// MotionRetention keeps recordings with motion for longer than recordings without it, instead of RecordingAgeLimitHours
+	MotionRetention MotionRetentionConfig `json:"motion_retention"`
+
+	// MotionEvents tunes how motion is merged into events, see GET /api/motion-events
+	MotionEvents MotionEventsConfig `json:"motion_events"`
+
+	// MotionAlert sends alerts when motion is detected in this stream's recordings.
+	// Alerts are delivered to webhooks subscribed to motion.alert, and over MQTT and SMTP if configured.
+	MotionAlert MotionAlertConfig `json:"motion_alert"`
+}
+
+// MotionMinimumScore is MotionDetectionMinimumScore with the default applied
+func (i Input) MotionMinimumScore() int {
+	if i.MotionDetectionMinimumScore == 0 {
+		return 10
+	}
+	return i.MotionDetectionMinimumScore
 }
 
 // RecordingDirectory contains .mp4 files saved from this stream
@@ -97,13 +197,47 @@ type Config struct {
 	// If 1, run every minute.
 	// If 60, run every 60 minutes, etc.
 	PruneIntervalMinutes int `json:"prune_interval_minutes"`
+	// StorageBudget limits the space recordings of all inputs take up together.
+	// Pruning deletes the oldest recordings of any input first, see Input.StoragePriority.
+	StorageBudget StorageBudgetConfig `json:"storage_budget"`
+	// DiskSpace prunes immediately when the filesystem media/ is on runs low on free space.
+	DiskSpace DiskSpaceConfig `json:"disk_space"`
 	// MotionDetectionWorkers determines how many motion detection goroutines to run.
 	// If 0, uses one worker per input or at least two goroutines - whichever is greater.
 	MotionDetectionWorkers int `json:"motion_detection_workers"`
+	// ShutdownTimeoutSeconds is how long we wait for recorders, thumbnails, motion detection and HTTP requests to finish after receiving SIGINT or SIGTERM.
+	// Work still running after this is killed.
+	// If 0, defaults to 30 seconds.
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+	// ReadyMinimumHealthyStreamFraction is the fraction of streams that must not be in error for /readyz to pass.
+	// If 0, /readyz passes regardless of stream health.
+	// If 1, every stream must be healthy.
+	ReadyMinimumHealthyStreamFraction float64 `json:"ready_min_healthy_stream_fraction"`
+	// Listen configures the addresses, TLS and Unix socket the web UI and API are served on.
+	// If empty, plain HTTP is served on :3000.
+	Listen ListenConfig `json:"listen"`
+	// Webhooks are sent when streams go offline, come back online, crash-loop or recover,
+	// or on any other event from /api/events.
+	Webhooks []Webhook `json:"webhooks"`
+	// Alerts configures how motion alerts are delivered, see Input.MotionAlert
+	Alerts AlertsConfig `json:"alerts"`
+	// MQTT connects to an MQTT broker, if configured
+	MQTT MQTTConfig `json:"mqtt"`
+	// Auth configures who can access the web UI and API.
+	// If no users are configured, everything is public.
+	Auth AuthConfig `json:"auth"`
 	// Inputs is the list of input streams we should record
 	Inputs []Input `json:"inputs"`
 }
 
+// ShutdownTimeout is ShutdownTimeoutSeconds with the default applied
+func (c *Config) ShutdownTimeout() time.Duration {
+	if c.ShutdownTimeoutSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(c.ShutdownTimeoutSeconds) * time.Second
+}
+
 func (c *Config) InputByID(id string) *Input {
 	for _, input := range c.Inputs {
 		if input.ID == id {
@@ -133,8 +267,26 @@ func (v *AValue[T]) Store(val T) {
 	v.inner = &val
 }
 
+// Swap stores val and returns the previous value
+func (v *AValue[T]) Swap(val T) T {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	old := *new(T)
+	if v.inner != nil {
+		old = *v.inner
+	}
+	v.inner = &val
+	return old
+}
+
+// isRecordingFile returns true if fpath is a recording or one of the files we save next to it
+func isRecordingFile(fpath string) bool {
+	return strings.HasSuffix(fpath, ".mp4") || strings.HasSuffix(fpath, ".mp4.jpg") || strings.HasSuffix(fpath, ".mp4.json") || strings.HasSuffix(fpath, ".mp4.alert.jpg")
+}
+
 func parseRecordingTime(fpath string) (time.Time, error) {
 	fpath = strings.TrimSuffix(fpath, ".jpg")
+	fpath = strings.TrimSuffix(fpath, ".alert")
 	fpath = strings.TrimSuffix(fpath, ".json")
 	if len(fpath) < 24 {
 		return time.Time{}, fmt.Errorf("path is too short, cannot parse recording time: %v", fpath)
@@ -165,16 +317,43 @@ type Stream struct {
 	LastSegmentClosed AValue[time.Time]
 	// LastErr is set to the error received when starting or when waiting for the stream-capturing command
 	LastErr AValue[error]
-
-	// LastRestartInErr is set on a schedule. If true, it indicates LastRestart is less than five minutes ago (= the stream-capturing command could be crashlooping)
+	// LastErrReason is set to one of the ExitReason constants after the stream-capturing command stops,
+	// classified from its log output when possible
+	LastErrReason AValue[string]
+	// LastErrMessage is set to the last ffmpeg error line that was classified as an exit reason
+	LastErrMessage AValue[string]
+	// Restarts is incremented each time the stream-capturing command is restarted
+	Restarts atomic.Uint64
+	// ConsecutiveFailures is the amount of times the stream-capturing command has stopped since it last recorded for at least a minute
+	ConsecutiveFailures AValue[int]
+	// NextRestart is set to the time the stream-capturing command will be restarted, after it stops
+	NextRestart AValue[time.Time]
+
+	// LastRestartInErr is set on a schedule. If true, it indicates LastRestart is more recent than Input.RestartErrThreshold (= the stream-capturing command could be crashlooping)
 	LastRestartInErr AValue[bool]
-	// LastFileOpenedInErr is set on a schedule. If true, it indicates LastFileOpened is more than three minutes ago (= the stream-capturing command could be frozen or not recording)
+	// LastFileOpenedInErr is set on a schedule. If true, it indicates LastFileOpened is older than Input.FileOpenedErrThreshold (= the stream-capturing command could be frozen or not recording)
 	LastFileOpenedInErr AValue[bool]
-	// LastSegmentOpenedInErr is set on a schedule. If true, it indicates LastSegmentOpened is more than 15 minutes ago (= the stream-capturing command could be frozen or not recording)
+	// LastSegmentOpenedInErr is set on a schedule. If true, it indicates LastSegmentOpened is older than Input.SegmentOpenedErrThreshold (= the stream-capturing command could be frozen or not recording)
 	LastSegmentOpenedInErr AValue[bool]
-
-	// RestartRecording can be invoked to stop and restart the rtsp-to-hls.sh process
+	// PlaylistStalledInErr is set on a schedule. If true, it indicates the live stream playlist hasn't been written for longer than Input.StallThreshold (= the stream-capturing command could be frozen)
+	PlaylistStalledInErr AValue[bool]
+	// SegmentStalledInErr is set on a schedule. If true, it indicates the current recording hasn't grown for longer than Input.StallThreshold (= the stream-capturing command could be frozen)
+	SegmentStalledInErr AValue[bool]
+	// DiskFull is set by the disk space watcher. If true, it indicates free space of the filesystem media/ is on is below Config.DiskSpace's low-water mark
+	DiskFull AValue[bool]
+
+	// RestartRecording can be invoked to stop and restart the stream-capturing command
 	RestartRecording AValue[func()]
+	// StopRecording can be invoked to interrupt the stream-capturing command so it finalizes the current segment
+	StopRecording AValue[func()]
+
+	// LiveMotion is set if Input.LiveMotion is enabled
+	LiveMotion *LiveMotionDetector
+
+	// Paused is set to true while recording has been paused with SetPaused
+	Paused AValue[bool]
+	// pauseChanged is signalled by SetPaused when recording is paused or resumed
+	pauseChanged chan struct{}
 }
 
 type Recording struct {
@@ -183,18 +362,88 @@ type Recording struct {
 	Start   time.Time
 	End     time.Time
 	Path    string
+	// Size and ModTime are the size and modification time of the file at Path when it was last indexed.
+	// If either changes, the recording is probed again.
+	Size    int64
+	ModTime time.Time
+
+	// Thumbnail is true if a thumbnail has been generated at Path+".jpg"
+	Thumbnail bool
 
 	PerformedMotionDetect bool
 	Motion                []motion
+	// MotionAlgorithm, MotionAlgorithmVersion, MotionMinimumScore and MotionParams describe how Motion was detected.
+	// If any of these differ from the current settings, motion detection is performed again.
+	MotionAlgorithm        string
+	MotionAlgorithmVersion int
+	MotionMinimumScore     int
+	MotionParams           string
+}
+
+// MotionDetector describes how Motion was detected
+func (r Recording) MotionDetector() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        r.MotionAlgorithm,
+		AlgorithmVersion: r.MotionAlgorithmVersion,
+		MinimumScore:     r.MotionMinimumScore,
+		Params:           r.MotionParams,
+	}
+}
+
+// MotionUpToDate returns true if motion detection has been performed using the input's current detector and settings
+func (r Recording) MotionUpToDate(input Input) bool {
+	return r.PerformedMotionDetect && input.motionResultsCurrent(r.MotionDetector())
 }
 
 type ApiV1Stream struct {
-	ID            string `json:"id"`
-	Name          string `json:"name"`
-	Active        bool   `json:"active"`
-	InErr         bool   `json:"in_err"`
-	LastRecording string `json:"last_recording"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	InErr  bool   `json:"in_err"`
+	// Paused is true while recording has been paused, see POST /api/streams/{id}/pause
+	Paused bool `json:"paused"`
+	// Motion is true while live motion detection sees motion
+	Motion bool `json:"motion"`
+	// FailingChecks are the names of the stream's failing health checks, see Stream.FailingChecks
+	FailingChecks []string `json:"failing_checks"`
+	LastRecording string   `json:"last_recording"`
 	Source        string
+
+	LastError           string `json:"last_error,omitempty"`
+	LastErrorReason     string `json:"last_error_reason,omitempty"`
+	LastErrorMessage    string `json:"last_error_message,omitempty"`
+	Restarts            uint64 `json:"restarts"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	NextRestart         string `json:"next_restart,omitempty"`
+}
+
+func newApiV1Stream(stream *Stream) ApiV1Stream {
+	apiStream := ApiV1Stream{
+		ID:                  stream.Input.ID,
+		Name:                stream.Input.Name,
+		Active:              stream.Active.Load(),
+		Paused:              stream.Paused.Load(),
+		FailingChecks:       stream.FailingChecks(),
+		LastRecording:       stream.LastSegmentClosed.Load().Format(time.RFC3339),
+		Source:              "/" + stream.Input.StreamPlaylistPath(),
+		LastErrorReason:     stream.LastErrReason.Load(),
+		LastErrorMessage:    stream.LastErrMessage.Load(),
+		Restarts:            stream.Restarts.Load(),
+		ConsecutiveFailures: stream.ConsecutiveFailures.Load(),
+	}
+	apiStream.InErr = len(apiStream.FailingChecks) > 0
+	if stream.LiveMotion != nil {
+		apiStream.Motion = stream.LiveMotion.Moving.Load()
+	}
+	if err := stream.LastErr.Load(); err != nil {
+		apiStream.LastError = err.Error()
+	}
+	if !apiStream.Active {
+		if nextRestart := stream.NextRestart.Load(); nextRestart.After(time.Now()) {
+			apiStream.NextRestart = nextRestart.Format(time.RFC3339)
+		}
+	}
+	return apiStream
 }
 
 type ApiV1Recording struct {
@@ -208,11 +457,17 @@ type ApiV1Recording struct {
 
 	PerformedMotionDetect bool          `json:"performed_motion_detect"`
 	Motion                []ApiV1Motion `json:"motion"`
+	MaxMotionScore        int           `json:"max_motion_score"`
+
+	// Lock protects the recording from pruning, if it is locked
+	Lock *RecordingLock `json:"lock,omitempty"`
 }
 
 type ApiV1Motion struct {
 	Time  int `json:"t"`
 	Score int `json:"s"`
+	// Zones are the scores of each motion zone, if the input has any
+	Zones map[string]int `json:"z,omitempty"`
 }
 
 var logger = logrus.New()
@@ -228,58 +483,86 @@ func sizeOfDir(path string) (int64, error) {
 	return size, err
 }
 
+// loadConfig reads the config from CREAMY_NVR_CONFIG, or config.json if unset, and exits if it is invalid
+func loadConfig() Config {
+	configBytes, err := readConfig()
+	if err != nil {
+		logger.WithError(err).Fatal("failed to read config.json")
+	}
+
+	config, err := parseConfig(configBytes)
+	if err != nil {
+		logger.WithError(err).WithField("raw-config", string(configBytes)).Fatal("invalid config")
+	}
+
+	if config.Debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
+	return config
+}
+
 func main() {
 	// todo: store segments to tmpfs
 	// todo: compress and migrate segments from local to remote storage
 
 	logger.SetFormatter(&logrus.JSONFormatter{})
 
-	var (
-		configBytes []byte
-		err         error
-	)
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		pruneCommand(os.Args[2:])
+		return
+	}
 
-	env := os.Getenv("CREAMY_NVR_CONFIG")
+	config := loadConfig()
 
-	if env == "" {
-		configBytes, err = os.ReadFile("config.json")
-		if err != nil {
-			logger.WithError(err).Fatal("failed to read config.json")
-		}
-	} else {
-		configBytes = []byte(env)
+	authenticator, err := NewAuthenticator(config.Auth, config.Inputs)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid auth config")
+	}
+	if !config.Auth.Enabled() {
+		logger.Warn("no users configured, web UI and API are public")
 	}
 
-	config := Config{}
-	if err = json.Unmarshal(configBytes, &config); err != nil {
-		logger.WithError(err).WithField("raw-config", string(configBytes)).Fatal("failed to unmarshal config")
+	webhooks, err := NewWebhookDispatcher(config.Webhooks)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid webhooks config")
 	}
 
-	if config.Debug {
-		logger.SetLevel(logrus.DebugLevel)
+	var mqttClient *MQTTClient
+	if config.MQTT.Enabled() {
+		mqttClient, err = NewMQTTClient(config.MQTT)
+		if err != nil {
+			logger.WithError(err).Fatal("invalid mqtt config")
+		}
 	}
 
-	if len(config.Inputs) == 0 {
-		logger.Fatal("must have at least one stream")
+	alerter, err := NewAlerter(config.Alerts, config.Inputs, mqttClient)
+	if err != nil {
+		logger.WithError(err).Fatal("invalid alerts config")
 	}
 
-	ctx := context.Background()
+	// ctx is cancelled when we receive SIGINT or SIGTERM, or when something fatal happens after boot
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	ctx, shutdown := context.WithCancel(signalCtx)
+	defer shutdown()
+	// workCtx outlives ctx so thumbnails and motion detection already in progress can finish while shutting down
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
-	if _, err := os.Stat("rtsp-to-hls.sh"); os.IsNotExist(err) {
-		logger.Warn("rtsp-to-hls.sh not found, using embedded copy")
-		if err := os.WriteFile("rtsp-to-hls.sh", script, 0700); err != nil {
-			logger.WithError(err).Error("failed to write rtsp-to-hls.sh, please create it manually")
-			os.Exit(1)
-		}
+	index, err := OpenRecordingIndex(IndexPath)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to open recording index")
 	}
 
 	recordings := []Recording{}
 	recordingsLock := sync.RWMutex{}
 	saveRecording := make(chan Recording)
 	sortRecording := make(chan bool)
+	setRecordingThumbnail := make(chan string)
 	type addRecordingMotionParams struct {
 		RecordingID string
 		Motion      []motion
+		Detector    MotionDetectorInfo
 	}
 	addRecordingMotion := make(chan addRecordingMotionParams)
 
@@ -287,7 +570,42 @@ func main() {
 		InputID       string
 		RecordingID   string
 		RecordingPath string
+		// Alert is true for new recordings, which can send motion alerts
+		Alert bool
+	}
+
+	// storeMotion saves the motion detected in a recording, and sends an alert if work.Alert is set
+	storeMotion := func(work performMotionDetectionParams, m []motion, detector MotionDetectorInfo) {
+		if err := writeMotionSidecar(work.RecordingPath, detector, m); err != nil {
+			logger.WithError(err).WithField("unit", "recordings-loader").WithField("path", work.RecordingPath).WithField("input", work.InputID).Warn("failed to write motion sidecar, motion will be detected again next boot")
+		}
+		addRecordingMotion <- addRecordingMotionParams{
+			RecordingID: work.RecordingID,
+			Motion:      m,
+			Detector:    detector,
+		}
+		if !work.Alert {
+			return
+		}
+		var (
+			recording Recording
+			found     bool
+		)
+		recordingsLock.RLock()
+		for i := range recordings {
+			if recordings[i].ID == work.RecordingID {
+				recording, found = recordings[i], true
+				break
+			}
+		}
+		recordingsLock.RUnlock()
+		if found {
+			recording.PerformedMotionDetect = true
+			recording.Motion = m
+			alerter.Check(workCtx, recording, m)
+		}
 	}
+
 	// todo: workers per recording stream instead. load motion using different worker pool
 	performMotionDetection := make(chan performMotionDetectionParams)
 	motionDetectionWorkers := config.MotionDetectionWorkers
@@ -297,227 +615,135 @@ func main() {
 			motionDetectionWorkers = 2
 		}
 	}
+	metrics.MotionDetectionWorkers.Store(int64(motionDetectionWorkers))
+	var motionDetectionWorkersWG sync.WaitGroup
 	for range motionDetectionWorkers {
+		motionDetectionWorkersWG.Add(1)
 		go func() {
+			defer motionDetectionWorkersWG.Done()
 			doWork := func(work performMotionDetectionParams) {
-				ctx, cancel := context.WithTimeout(ctx, 4*time.Minute)
-				defer cancel()
+				metrics.MotionDetectionWorkersBusy.Add(1)
+				defer metrics.MotionDetectionWorkersBusy.Add(-1)
+				started := time.Now()
 
-				recordingID := path.Base(work.RecordingPath)
-				minScore := 0
-				input := config.InputByID(work.InputID)
-				if input != nil {
-					minScore = input.MotionDetectionMinimumScore
-				}
-				if minScore == 0 {
-					minScore = 10
+				detector := Input{}.MotionDetector()
+				if input := config.InputByID(work.InputID); input != nil {
+					detector = input.MotionDetector()
 				}
-				m, err := motionTimeline(ctx, work.RecordingPath, minScore)
+				info := detector.Info()
+				// each detector limits how long it can run, see MotionCommandConfig.TimeoutSeconds
+				m, err := detector.Detect(workCtx, work.RecordingPath)
+				metrics.MotionDetectionDuration.Observe(time.Since(started).Seconds())
 				if err != nil {
+					metrics.MotionDetectionJobs.Add(1, "stream", work.InputID, "detector", info.Algorithm, "result", "failure")
 					logger.WithError(err).WithField("unit", "recordings-loader").WithField("path", work.RecordingPath).WithField("input", work.InputID).Warn("failed to perform motion detect on old recording, skipping")
 				} else {
-					addRecordingMotion <- addRecordingMotionParams{
-						RecordingID: recordingID,
-						Motion:      m,
-					}
+					metrics.MotionDetectionJobs.Add(1, "stream", work.InputID, "detector", info.Algorithm, "result", "success")
+					storeMotion(work, m, info)
 					logger.WithField("unit", "recordings-loader").WithField("path", work.RecordingPath).WithField("input", work.InputID).Debug("performed motion detect")
 				}
 			}
 
 			for work := range performMotionDetection {
+				metrics.MotionDetectionQueueDepth.Add(-1)
 				doWork(work)
 			}
 		}()
 	}
 
+	streamName := func(inputID string) string {
+		if input := config.InputByID(inputID); input != nil {
+			return input.Name
+		}
+		return ""
+	}
+
 	removeRecordingFromMem := func(path string) {
 		recordingsLock.Lock()
-		defer recordingsLock.Unlock()
-
+		var (
+			removed Recording
+			found   bool
+		)
 		for i, r := range recordings {
 			if r.Path == path {
+				removed, found = r, true
 				recordings = append(recordings[:i], recordings[i+1:]...)
 				break
 			}
 		}
+		recordingsLock.Unlock()
+
+		if strings.HasSuffix(path, ".mp4") {
+			if err := index.Delete(path); err != nil {
+				logger.WithError(err).WithField("path", path).Warn("failed to remove recording from index")
+			}
+		}
+		if found {
+			publishRecordingEvent(EventRecordingPruned, removed, streamName(removed.InputID))
+		}
 	}
 
 	pruneLock := sync.Mutex{}
-	prune := func() {
+	runPruneNow := func(dryRun bool) (ApiV1PruneResult, error) {
 		pruneLock.Lock()
 		defer pruneLock.Unlock()
-		logger := logger.WithField("unit", "prune")
+		logger := logger.WithField("unit", "prune").WithField("dry-run", dryRun)
 
 		logger.Debug("performing prune")
 
-		for _, input := range config.Inputs {
-			// prune recordings by date
-			if input.RecordingAgeLimitHours > 0 {
-				target := time.Now().Add(-1 * time.Hour * time.Duration(input.RecordingAgeLimitHours))
-				err := filepath.Walk(input.RecordingDirectory(), func(path string, info fs.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					if info.IsDir() {
-						return nil
-					}
-					if (!strings.HasSuffix(path, ".mp4") && !strings.HasSuffix(path, ".mp4.jpg")) || !strings.Contains(path, input.ID) || len(path) <= 24 {
-						return fmt.Errorf("unexpected file found in recording directory: %v", path)
-					}
-
-					recordingDate, err := parseRecordingTime(path)
-					if err != nil {
-						return fmt.Errorf("failed to parse time from path %v: %v", path, err)
-					}
-
-					if recordingDate.After(target) {
-						return filepath.SkipAll // we have reduced enough storage already
-					}
-
-					if err := os.Remove(path); err != nil {
-						return fmt.Errorf("failed pruning recording at %v: %v", path, err)
-					}
-					logger.WithField("path", path).WithField("input", input.ID).Debug("pruned recording due to date")
-
-					removeRecordingFromMem(path)
-
-					return nil
-				})
-				if err != nil {
-					logger.WithError(err).WithField("input", input.ID).Error("failed to perform recording date prune")
-				}
-				logger.WithField("target", target).WithField("input", input.ID).Debug("pruned recordings by date")
-			}
-
-			// prune recordings by size
-			if input.RecordingSizeLimitMegabytes > 0 {
-				target := int64(input.RecordingSizeLimitMegabytes) * 1000 * 1000
-				size, err := sizeOfDir(input.RecordingDirectory())
-				if err != nil {
-					logger.WithError(err).WithField("input", input.ID).Error("failed to get size of recording dir")
-				} else if size > target {
-					newSize := size
-					err = filepath.Walk(input.RecordingDirectory(), func(path string, info fs.FileInfo, err error) error {
-						if err != nil {
-							return err
-						}
-						if newSize <= target {
-							return filepath.SkipAll // we have reduced enough storage already
-						}
-						if info.IsDir() {
-							return nil
-						}
-						if (!strings.HasSuffix(path, ".mp4") && !strings.HasSuffix(path, ".mp4.jpg")) || !strings.Contains(path, input.ID) {
-							return fmt.Errorf("unexpected file found in recording directory: %v", path)
-						}
-						recordingSize := info.Size()
-						if err := os.Remove(path); err != nil {
-							return fmt.Errorf("failed pruning recording at %v: %v", path, err)
-						}
-						logger.WithField("path", path).WithField("input", input.ID).Debug("pruned recording due to size")
-						newSize -= recordingSize
-
-						removeRecordingFromMem(path)
+		result, err := runPrune(logger, &config, index, time.Now(), dryRun, removeRecordingFromMem)
+		if err != nil {
+			return result, err
+		}
+		logger.WithField("bytes", result.DeletedBytes).Debug("pruned")
+		if dryRun {
+			return result, nil
+		}
 
-						return nil
-					})
-					if err != nil {
-						logger.WithError(err).WithField("input", input.ID).Error("failed to perform recording size limit prune")
-					}
-					logger.WithField("target", target).WithField("size", size).WithField("new-size", newSize).WithField("input", input.ID).Debug("pruned recordings by size")
-				}
+		for _, input := range config.Inputs {
+			if size, err := sizeOfDir(input.RecordingDirectory()); err == nil {
+				metrics.DirectoryBytes.Set(float64(size), "stream", input.ID, "directory", "recording")
 			}
-
-			// prune stream segments by date
-			if input.StreamAgeLimitHours > 0 {
-				target := time.Now().Add(-1 * time.Hour * time.Duration(input.StreamAgeLimitHours))
-				err := filepath.Walk(input.StreamSegmentDirectory(), func(path string, info fs.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					if info.IsDir() {
-						return nil
-					}
-					if !strings.HasSuffix(path, ".ts") || !strings.Contains(path, input.ID) || len(path) <= 24 {
-						return fmt.Errorf("unexpected file found in stream segment directory: %v", path)
-					}
-
-					// abcd-000001-2025-05-01-22-21-52.ts
-					streamSegmentDateRaw := path[len(path)-22 : len(path)-3]
-					streamSegmentDate, err := time.Parse("2006-01-02-15-04-05", streamSegmentDateRaw)
-					if err != nil {
-						return fmt.Errorf("failed to parse time from path %v: %v", path, err)
-					}
-
-					if streamSegmentDate.After(target) {
-						return filepath.SkipAll // we have reduced enough storage already
-					}
-
-					if err := os.Remove(path); err != nil {
-						return fmt.Errorf("failed pruning stream segment at %v: %v", path, err)
-					}
-					logger.WithField("path", path).WithField("input", input.ID).Debug("pruned stream segment due to date")
-
-					return nil
-				})
-				if err != nil {
-					logger.WithError(err).WithField("input", input.ID).Error("failed to perform stream segment date prune")
-				}
-				logger.WithField("target", target).WithField("input", input.ID).Debug("pruned stream segments by date")
+			if size, err := sizeOfDir(input.StreamSegmentDirectory()); err == nil {
+				metrics.DirectoryBytes.Set(float64(size), "stream", input.ID, "directory", "stream_segment")
 			}
-
-			// prune stream segments by size
-			if input.StreamSizeLimitMegabytes > 0 {
-				target := int64(input.StreamSizeLimitMegabytes) * 1000 * 1000
-				size, err := sizeOfDir(input.StreamSegmentDirectory())
-				if err != nil {
-					logger.WithError(err).WithField("input", input.ID).Error("failed to get size of stream segment dir")
-				} else if size > target {
-					newSize := size
-					err = filepath.Walk(input.StreamSegmentDirectory(), func(path string, info fs.FileInfo, err error) error {
-						if err != nil {
-							return err
-						}
-						if newSize <= target {
-							return filepath.SkipAll // we have reduced enough storage already
-						}
-						if info.IsDir() {
-							return nil
-						}
-						if !strings.HasSuffix(path, ".ts") || !strings.Contains(path, input.ID) {
-							return fmt.Errorf("unexpected file found in stream segment directory: %v", path)
-						}
-						streamSegmentSize := info.Size()
-						if err := os.Remove(path); err != nil {
-							return fmt.Errorf("failed pruning stream segment at %v: %v", path, err)
-						}
-						logger.WithField("path", path).WithField("input", input.ID).Debug("pruned stream segment due to size")
-						newSize -= streamSegmentSize
-						return nil
-					})
-					if err != nil {
-						logger.WithError(err).WithField("input", input.ID).Error("failed to perform stream segment size limit prune")
-					}
-					logger.WithField("target", target).WithField("size", size).WithField("new-size", newSize).WithField("input", input.ID).Debug("pruned stream segments by size")
-				}
+			if size, err := sizeOfDir(input.ClipDirectory()); err == nil {
+				metrics.DirectoryBytes.Set(float64(size), "stream", input.ID, "directory", "clip")
 			}
 		}
+		return result, nil
+	}
+	prune := func() {
+		if _, err := runPruneNow(false); err != nil {
+			logger.WithField("unit", "prune").WithError(err).Error("failed to prune")
+		}
 	}
 
 	if config.PruneIntervalMinutes > 0 {
 		go func() {
 			ticker := time.NewTicker(time.Minute * time.Duration(config.PruneIntervalMinutes))
 			defer ticker.Stop()
-			for range ticker.C {
-				prune()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					prune()
+				}
 			}
 		}()
 	}
 	go prune()
 
+	// the recordings goroutine is stopped last during shutdown, after everything that sends to it
+	stopRecordings := make(chan struct{})
+	recordingsStopped := make(chan struct{})
 	go func() {
+		defer close(recordingsStopped)
 		for {
 			select {
+			case <-stopRecordings:
+				return
 			case recording := <-saveRecording:
 				recordingsLock.Lock()
 				recordings = append(recordings, recording)
@@ -538,27 +764,77 @@ func main() {
 				recordingsLock.Unlock()
 			case p := <-addRecordingMotion:
 				recordingsLock.Lock()
+				var (
+					updated Recording
+					found   bool
+				)
 				for i := range recordings {
 					if recordings[i].ID == p.RecordingID {
 						recordings[i].PerformedMotionDetect = true
 						recordings[i].Motion = p.Motion
+						recordings[i].MotionAlgorithm = p.Detector.Algorithm
+						recordings[i].MotionAlgorithmVersion = p.Detector.AlgorithmVersion
+						recordings[i].MotionMinimumScore = p.Detector.MinimumScore
+						recordings[i].MotionParams = p.Detector.Params
+						updated, found = recordings[i], true
 						break
 					}
 				}
 				logger.WithField("payload", p).Debug("added motion")
 				recordingsLock.Unlock()
+				if found {
+					if err := index.Put(updated); err != nil {
+						logger.WithError(err).WithField("path", updated.Path).Warn("failed to store recording motion in index")
+					}
+					publishRecordingEvent(EventRecordingMotion, updated, streamName(updated.InputID))
+				}
+			case segment := <-setRecordingThumbnail:
+				recordingsLock.Lock()
+				var (
+					updated Recording
+					found   bool
+				)
+				for i := range recordings {
+					if recordings[i].Path == segment {
+						recordings[i].Thumbnail = true
+						updated, found = recordings[i], true
+						break
+					}
+				}
+				recordingsLock.Unlock()
+				if found {
+					if err := index.Put(updated); err != nil {
+						logger.WithError(err).WithField("path", updated.Path).Warn("failed to store recording thumbnail in index")
+					}
+					publishRecordingEvent(EventRecordingThumbnail, updated, streamName(updated.InputID))
+				}
 			}
 		}
 	}()
 
+	// segmentQueuesWG tracks the per-input thumbnail and motion detection queue goroutines,
+	// which exit after closeSegmentQueues is called during shutdown
+	var segmentQueuesWG sync.WaitGroup
+	closeSegmentQueues := []func(){}
+	streams := make([]Stream, len(config.Inputs))
+
+	// closedSegment is a recording waiting for motion detection
+	type closedSegment struct {
+		path   string
+		opened time.Time
+		closed time.Time
+	}
+
 	makeSaveRecording := func(inputIdx int) func(time.Time, string) {
 		// recordingIdx := uint64(0)
 
 		thumbnailQueue := make(chan string, 1)
+		segmentQueuesWG.Add(1)
 		go func() {
+			defer segmentQueuesWG.Done()
 			loggerInfo := logger.WriterLevel(logrus.DebugLevel)
 			genThumbnail := func(segment string) error {
-				ctx, cancel := context.WithTimeout(ctx, time.Minute)
+				ctx, cancel := context.WithTimeout(workCtx, time.Minute)
 				defer cancel()
 				cmd := exec.CommandContext(
 					ctx,
@@ -575,24 +851,45 @@ func main() {
 			for segment := range thumbnailQueue {
 				if err := genThumbnail(segment); err != nil {
 					logger.WithField("segment", segment).WithError(err).Warn("failed to generate thumbnail, ignoring")
+					metrics.ThumbnailFailures.Add(1, "stream", config.Inputs[inputIdx].ID)
+				} else {
+					setRecordingThumbnail <- segment
 				}
 			}
 		}()
 
-		motionDetectQueue := make(chan string, 1)
+		motionDetectQueue := make(chan closedSegment, 1)
+		segmentQueuesWG.Add(1)
 		go func() {
+			defer segmentQueuesWG.Done()
 			for segment := range motionDetectQueue {
-				performMotionDetection <- performMotionDetectionParams{
+				work := performMotionDetectionParams{
 					InputID:       config.Inputs[inputIdx].ID,
-					RecordingID:   path.Base(segment),
-					RecordingPath: segment,
+					RecordingID:   path.Base(segment.path),
+					RecordingPath: segment.path,
+					Alert:         true,
 				}
+				// use the live stream's scores if it was scored the whole time, instead of decoding the recording again
+				if liveMotion := streams[inputIdx].LiveMotion; liveMotion != nil {
+					if m, ok := liveMotion.Timeline(segment.opened, segment.closed); ok {
+						metrics.MotionDetectionQueueDepth.Add(-1)
+						storeMotion(work, m, config.Inputs[inputIdx].liveMotionInfo())
+						continue
+					}
+					logger.WithField("segment", segment.path).Debug("live motion detection did not cover the recording, detecting motion from the recording instead")
+				}
+				performMotionDetection <- work
 			}
 		}()
 
+		closeSegmentQueues = append(closeSegmentQueues, func() {
+			close(thumbnailQueue)
+			close(motionDetectQueue)
+		})
+
 		return func(opened time.Time, segment string) {
 			// newRecordingIdx := atomic.AddUint64(&recordingIdx, 1)
-			saveRecording <- Recording{
+			recording := Recording{
 				// ID:      fmt.Sprintf("%v_%v-%v", time.Now().Unix(), inputIdx, newRecordingIdx),
 				ID:      path.Base(segment),
 				InputID: config.Inputs[inputIdx].ID,
@@ -600,16 +897,26 @@ func main() {
 				End:     time.Now(),
 				Path:    segment,
 			}
+			if info, err := os.Stat(segment); err == nil {
+				recording.Size = info.Size()
+				recording.ModTime = info.ModTime()
+			}
+			if err := index.Put(recording); err != nil {
+				logger.WithError(err).WithField("segment", segment).Warn("failed to store recording in index")
+			}
+			saveRecording <- recording
+			publishRecordingEvent(EventRecordingNew, recording, config.Inputs[inputIdx].Name)
 			thumbnailQueue <- segment
 			select {
-			case motionDetectQueue <- segment:
+			case motionDetectQueue <- closedSegment{path: segment, opened: opened, closed: recording.End}:
+				metrics.MotionDetectionQueueDepth.Add(1)
 			default:
 				logger.WithField("segment", segment).Warn("local motion detect queue full, skipping")
 			}
 		}
 	}
 
-	streams := make([]Stream, len(config.Inputs))
+	var recordersWG sync.WaitGroup
 	for i := range config.Inputs {
 		streams[i].Input = config.Inputs[i]
 		streams[i].Active.Store(false)
@@ -623,7 +930,25 @@ func main() {
 		streams[i].LastFileOpenedInErr.Store(true)
 		streams[i].LastSegmentOpenedInErr.Store(true)
 		streams[i].LastRestartInErr.Store(true)
-		go record(ctx, &streams[i])
+		streams[i].PlaylistStalledInErr.Store(true)
+		streams[i].SegmentStalledInErr.Store(true)
+		streams[i].Paused.Store(false)
+		streams[i].pauseChanged = make(chan struct{}, 1)
+		if streams[i].Input.LiveMotion.Enabled {
+			streams[i].LiveMotion = NewLiveMotionDetector(&streams[i])
+		}
+		recordersWG.Add(1)
+		go func() {
+			defer recordersWG.Done()
+			record(ctx, &streams[i], config.ShutdownTimeout())
+		}()
+		if streams[i].LiveMotion != nil {
+			recordersWG.Add(1)
+			go func() {
+				defer recordersWG.Done()
+				streams[i].LiveMotion.Run(ctx)
+			}()
+		}
 	}
 
 	streamIdxMap := make(map[string]int, len(streams))
@@ -631,7 +956,49 @@ func main() {
 		streamIdxMap[streams[i].Input.ID] = i
 	}
 
+	if mqttClient != nil {
+		bridge := NewMQTTBridge(mqttClient, streams, streamIdxMap)
+		go bridge.Run(ctx)
+		mqttClient.Connect()
+	}
+
+	var indexLoaded AValue[bool]
+	loaderStopped := make(chan struct{})
 	go func() {
+		defer close(loaderStopped)
+		logger := logger.WithField("unit", "recordings-loader")
+
+		indexed, err := index.All()
+		if err != nil {
+			logger.WithError(err).Warn("failed to load recording index, all recordings will be probed")
+			indexed = map[string]Recording{}
+		}
+
+		pendingMotionDetection := []performMotionDetectionParams{}
+		restoreMotion := func(input Input, recording Recording) {
+			if recording.MotionUpToDate(input) {
+				return
+			}
+			sidecar, m, err := readMotionSidecar(recording.Path)
+			if err == nil && sidecar.Matches(input) {
+				addRecordingMotion <- addRecordingMotionParams{
+					RecordingID: recording.ID,
+					Motion:      m,
+					Detector:    sidecar.MotionDetectorInfo,
+				}
+				logger.WithField("path", recording.Path).WithField("input", input.ID).Debug("loaded motion from sidecar")
+				return
+			}
+			if err != nil && !os.IsNotExist(err) {
+				logger.WithError(err).WithField("path", recording.Path).WithField("input", input.ID).Warn("failed to read motion sidecar, motion will be detected again")
+			}
+			pendingMotionDetection = append(pendingMotionDetection, performMotionDetectionParams{
+				InputID:       input.ID,
+				RecordingID:   recording.ID,
+				RecordingPath: recording.Path,
+			})
+		}
+
 		for _, input := range config.Inputs {
 			err := filepath.Walk(input.RecordingDirectory(), func(fpath string, info fs.FileInfo, err error) error {
 				if err != nil {
@@ -640,6 +1007,9 @@ func main() {
 					}
 					return err
 				}
+				if ctx.Err() != nil {
+					return ctx.Err() // shutting down
+				}
 				if !strings.HasSuffix(fpath, ".mp4") || !strings.Contains(fpath, input.ID) {
 					return nil
 				}
@@ -649,7 +1019,25 @@ func main() {
 					return fmt.Errorf("failed to parse time from path %v: %v", fpath, err)
 				}
 
-				// todo: load this from datastore instead of calling ffprobe on every recording on boot
+				_, thumbnailErr := os.Stat(fpath + ".jpg")
+				hasThumbnail := thumbnailErr == nil
+
+				recording, ok := indexed[fpath]
+				delete(indexed, fpath)
+				if ok && recording.InputID == input.ID && recording.Size == info.Size() && recording.ModTime.Equal(info.ModTime()) {
+					// unchanged since it was indexed, no need to probe it again
+					if recording.Thumbnail != hasThumbnail {
+						recording.Thumbnail = hasThumbnail
+						if err := index.Put(recording); err != nil {
+							logger.WithError(err).WithField("path", fpath).Warn("failed to update recording in index")
+						}
+					}
+					saveRecording <- recording
+					restoreMotion(input, recording)
+					logger.WithField("path", fpath).WithField("input", input.ID).Debug("loaded recording from index")
+					return nil
+				}
+
 				ctx, cancel := context.WithTimeout(ctx, time.Minute)
 				defer cancel()
 				ffprobe := exec.CommandContext(
@@ -682,113 +1070,63 @@ func main() {
 				end := recordingDate.Add(time.Second * time.Duration(durationI))
 
 				recordingID := path.Base(fpath)
-				saveRecording <- Recording{
-					ID:      recordingID,
-					InputID: input.ID,
-					Start:   recordingDate,
-					End:     end,
-					Path:    fpath, // todo: make into subdir
+				recording = Recording{
+					ID:        recordingID,
+					InputID:   input.ID,
+					Start:     recordingDate,
+					End:       end,
+					Path:      fpath, // todo: make into subdir
+					Size:      info.Size(),
+					ModTime:   info.ModTime(),
+					Thumbnail: hasThumbnail,
+				}
+				if err := index.Put(recording); err != nil {
+					logger.WithError(err).WithField("path", fpath).Warn("failed to store recording in index")
 				}
-				logger.WithField("unit", "recordings-loader").WithField("path", fpath).WithField("input", input.ID).Debug("loaded recording")
+				saveRecording <- recording
+				restoreMotion(input, recording)
+				logger.WithField("path", fpath).WithField("input", input.ID).Debug("loaded recording")
 
 				return nil
 			})
 			sortRecording <- true
+			if ctx.Err() != nil {
+				return
+			}
 			if err != nil {
 				logger.WithError(err).WithField("input", input.ID).Warn("failed to parse old recordings, ignoring")
 			}
 		}
 
-		for _, input := range config.Inputs {
-			err := filepath.Walk(input.RecordingDirectory(), func(fpath string, info fs.FileInfo, err error) error {
-				if err != nil {
-					if os.IsNotExist(err) {
-						return nil // if something is pruned between call to Walk and Walk's call to Stat
-					}
-					return err
-				}
-				if !strings.HasSuffix(fpath, ".mp4") || !strings.Contains(fpath, input.ID) {
-					return nil
-				}
-
-				if _, err := parseRecordingTime(fpath); err != nil {
-					return fmt.Errorf("failed to parse time from path %v: %v", fpath, err)
-				}
-
-				performMotionDetection <- performMotionDetectionParams{
-					InputID:       input.ID,
-					RecordingID:   path.Base(fpath),
-					RecordingPath: fpath,
-				}
-
-				return nil
-			})
-			if err != nil {
-				logger.WithError(err).WithField("input", input.ID).Warn("failed to parse old recordings motion detect, ignoring")
+		// anything left over was removed from disk while we weren't looking
+		for fpath := range indexed {
+			if err := index.Delete(fpath); err != nil {
+				logger.WithError(err).WithField("path", fpath).Warn("failed to remove missing recording from index")
+			} else {
+				logger.WithField("path", fpath).Debug("removed missing recording from index")
 			}
 		}
-	}()
+		indexLoaded.Store(true)
+		logger.Info("loaded recordings")
 
-	go func() {
-		timer := time.NewTimer(30 * time.Second)
-		for {
+		metrics.MotionDetectionQueueDepth.Add(int64(len(pendingMotionDetection)))
+		for i, work := range pendingMotionDetection {
 			select {
 			case <-ctx.Done():
+				metrics.MotionDetectionQueueDepth.Add(-int64(len(pendingMotionDetection) - i))
 				return
-			case <-timer.C:
-				for i := range streams {
-					stream := &streams[i]
-					lastRestart := stream.LastRestart.Load()
-					lastRestartInErr := time.Since(lastRestart) < 5*time.Minute
-					lastRestartCurrentlyInErr := stream.LastRestartInErr.Load()
-
-					if lastRestartInErr && !lastRestartCurrentlyInErr {
-						logger.WithField("last-restart", lastRestart).Warn("stream restarted less than 5 minutes ago")
-					} else if !lastRestartInErr && lastRestartCurrentlyInErr {
-						logger.WithField("last-restart", lastRestart).Info("stream has been up at least 5 minutes")
-					}
-
-					lastFileOpened := stream.LastFileOpened.Load()
-					lastFileOpenedInErr := time.Since(lastFileOpened) > 3*time.Minute
-					lastFileOpenedCurrentlyInErr := stream.LastFileOpenedInErr.Load()
-
-					if lastFileOpenedInErr && !lastFileOpenedCurrentlyInErr {
-						logger.WithField("last-open", lastFileOpened).Warn("stream has not opened file for at least 3 minutes, restarting")
-						restart := stream.RestartRecording.Load()
-						if restart != nil {
-							restart()
-						} else {
-							logger.Warn("stream.RestartRecording is nil!")
-						}
-					} else if !lastFileOpenedInErr && lastFileOpenedCurrentlyInErr {
-						logger.WithField("last-open", lastFileOpened).Info("stream has opened a file in the last 3 minutes")
-					}
-
-					lastSegmentOpened := stream.LastSegmentOpened.Load()
-					lastSegmentOpenedInErr := time.Since(lastSegmentOpened) > 15*time.Minute
-					lastSegmentOpenedCurrentlyInErr := stream.LastSegmentOpenedInErr.Load()
-
-					if lastSegmentOpenedInErr && !lastSegmentOpenedCurrentlyInErr {
-						logger.WithField("last-open", lastSegmentOpened).Warn("stream has not opened segment for at least 15 minutes, restarting")
-						restart := stream.RestartRecording.Load()
-						if restart != nil {
-							restart()
-						} else {
-							logger.Warn("stream.RestartRecording is nil!")
-						}
-					} else if !lastSegmentOpenedInErr && lastSegmentOpenedCurrentlyInErr {
-						logger.WithField("last-open", lastSegmentOpened).Info("stream has opened a segment in the last 15 minutes")
-					}
-
-					stream.LastRestartInErr.Store(lastRestartInErr)
-					stream.LastFileOpenedInErr.Store(lastFileOpenedInErr)
-					stream.LastSegmentOpenedInErr.Store(lastSegmentOpenedInErr)
-				}
-				timer.Reset(time.Minute)
+			case performMotionDetection <- work:
 			}
 		}
 	}()
 
+	go watchdog(ctx, streams)
+	if config.DiskSpace.Enabled() {
+		go watchDiskSpace(ctx, &config, streams, prune)
+	}
+	go healthNotifier(ctx, streams)
+	go webhooks.Run(ctx, workCtx)
+
 	sub, err := fs.Sub(ui, "ui/dist")
 	if err != nil {
 		logger.WithError(err).Fatal("failed to move into ui/dist subfolder of embedded UI bundle")
@@ -796,44 +1134,380 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /api/streams", func(w http.ResponseWriter, r *http.Request) {
-		apiStreams := make([]ApiV1Stream, len(streams))
-		for i := range apiStreams {
-			apiStreams[i].ID = streams[i].Input.ID
-			apiStreams[i].Name = streams[i].Input.Name
-			apiStreams[i].Active = streams[i].Active.Load()
-			apiStreams[i].InErr = !apiStreams[i].Active || streams[i].LastFileOpenedInErr.Load() || streams[i].LastSegmentOpenedInErr.Load() || streams[i].LastRestartInErr.Load()
-			apiStreams[i].LastRecording = streams[i].LastSegmentClosed.Load().Format(time.RFC3339)
-			apiStreams[i].Source = fmt.Sprintf("/media/%v/stream/%v.m3u8", streams[i].Input.ID, streams[i].Input.ID)
+		user := UserFromContext(r.Context())
+		apiStreams := make([]ApiV1Stream, 0, len(streams))
+		for i := range streams {
+			if !user.CanAccessCamera(streams[i].Input.ID) {
+				continue
+			}
+			apiStreams = append(apiStreams, newApiV1Stream(&streams[i]))
 		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(&apiStreams)
 	})
-	mux.HandleFunc("GET /api/recordings", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("POST /api/streams/{id}/restart", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		streamIdx, ok := streamIdxMap[r.PathValue("id")]
+		if !ok || !UserFromContext(r.Context()).CanAccessCamera(r.PathValue("id")) {
+			writeJSONError(w, http.StatusNotFound, "stream not found")
+			return
+		}
+		stream := &streams[streamIdx]
+		restart := stream.RestartRecording.Load()
+		if !stream.Active.Load() || restart == nil {
+			writeJSONError(w, http.StatusConflict, "stream is not running, it will be restarted after its backoff")
+			return
+		}
+		logger.WithField("stream", stream.Input.ID).WithField("username", UserFromContext(r.Context()).Username).Info("restarting stream on request")
+		restart()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	setPaused := func(paused bool) http.HandlerFunc {
+		return RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+			streamIdx, ok := streamIdxMap[r.PathValue("id")]
+			if !ok || !UserFromContext(r.Context()).CanAccessCamera(r.PathValue("id")) {
+				writeJSONError(w, http.StatusNotFound, "stream not found")
+				return
+			}
+			stream := &streams[streamIdx]
+			logger.WithField("stream", stream.Input.ID).WithField("username", UserFromContext(r.Context()).Username).WithField("paused", paused).Info("pausing or resuming stream on request")
+			stream.SetPaused(paused)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	mux.HandleFunc("POST /api/streams/{id}/pause", setPaused(true))
+	mux.HandleFunc("POST /api/streams/{id}/resume", setPaused(false))
+	listMotionEvents := RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		q, err := parseMotionEventsQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// only copy out recordings that can contribute to matching events while holding the lock, merging happens afterwards
+		candidates := make([][]Recording, len(streams))
 		recordingsLock.RLock()
-		defer recordingsLock.RUnlock()
-		apiRecordings := make([]ApiV1Recording, len(recordings))
-		for i := range apiRecordings {
-			revIdx := len(recordings) - i - 1
-			streamIdx := streamIdxMap[recordings[revIdx].InputID]
-			apiRecordings[i].ID = recordings[revIdx].ID
-			apiRecordings[i].StreamID = recordings[revIdx].InputID
-			apiRecordings[i].StreamName = streams[streamIdx].Input.Name
-			apiRecordings[i].Start = recordings[revIdx].Start.Format(time.RFC3339)
-			apiRecordings[i].End = recordings[revIdx].End.Format(time.RFC3339)
-			apiRecordings[i].Path = "/" + strings.TrimPrefix(recordings[revIdx].Path, "/")
-			apiRecordings[i].ThumbnailPath = "/" + strings.TrimPrefix(recordings[revIdx].Path+".jpg", "/")
-			// todo: if these properties are large, only expose sometimes
-			apiRecordings[i].PerformedMotionDetect = recordings[revIdx].PerformedMotionDetect
-			apiRecordings[i].Motion = make([]ApiV1Motion, len(recordings[revIdx].Motion))
-			for ii := range len(recordings[revIdx].Motion) {
-				apiRecordings[i].Motion[ii].Time = recordings[revIdx].Motion[ii].Time
-				apiRecordings[i].Motion[ii].Score = recordings[revIdx].Motion[ii].Score
+		for _, recording := range recordings {
+			streamIdx, ok := streamIdxMap[recording.InputID]
+			if !ok || !user.CanAccessCamera(recording.InputID) || !q.IncludesStream(recording.InputID) {
+				continue
+			}
+			if q.MayContribute(recording, streams[streamIdx].Input.MotionEvents.Gap()) {
+				candidates[streamIdx] = append(candidates[streamIdx], recording)
+			}
+		}
+		recordingsLock.RUnlock()
+
+		motionEvents := []ApiV1MotionEvent{}
+		for i := range streams {
+			for _, motionEvent := range mergeMotionEvents(streams[i].Input, candidates[i]) {
+				if q.Matches(motionEvent) {
+					motionEvents = append(motionEvents, motionEvent)
+				}
+			}
+		}
+
+		// newest first, like recordings
+		sort.Slice(motionEvents, func(i, j int) bool {
+			return motionEvents[i].Start.After(motionEvents[j].Start)
+		})
+		writeJSON(w, motionEvents)
+	})
+	mux.HandleFunc("GET /api/motion-events", listMotionEvents)
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		// EventSource asks for live events, anything else lists motion events like GET /api/motion-events
+		w.Header().Set("Vary", "Accept")
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			serveEventStream(ctx, w, r)
+			return
+		}
+		listMotionEvents(w, r)
+	})
+	mux.HandleFunc("GET /api/webhooks/deliveries", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, webhooks.Deliveries())
+	}))
+	mux.HandleFunc("POST /api/prune", RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		dryRun := false
+		if raw := r.URL.Query().Get("dry_run"); raw != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(raw); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid dry_run, expected true or false")
+				return
+			}
+		}
+		// anybody who can list recordings can see what would be pruned, but pruning affects every camera,
+		// so only admins who can access all of them can delete recordings
+		if !dryRun && !user.CanAccessAllCameras(config.Inputs) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if !dryRun {
+			logger.WithField("username", user.Username).Info("pruning on request")
+		}
+
+		result, err := runPruneNow(dryRun)
+		if err != nil {
+			logger.WithError(err).Error("failed to prune")
+			writeJSONError(w, http.StatusInternalServerError, "failed to prune")
+			return
+		}
+		apiStreams := []ApiV1PruneStream{}
+		result.DeletedBytes = 0
+		for _, stream := range result.Streams {
+			if user.CanAccessCamera(stream.StreamID) {
+				apiStreams = append(apiStreams, stream)
+				result.DeletedBytes += stream.DeletedBytes
 			}
 		}
+		result.Streams = apiStreams
+		writeJSON(w, result)
+	}))
+	// the config covers every camera and every user, so only admins who can access all cameras can read or replace it
+	mux.HandleFunc("GET /api/config", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		if !UserFromContext(r.Context()).CanAccessAllCameras(config.Inputs) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		configBytes, err := readConfig()
+		if err != nil {
+			logger.WithError(err).Error("failed to read config")
+			writeJSONError(w, http.StatusInternalServerError, "failed to read config")
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(&apiRecordings)
+		w.Write(configBytes)
+	}))
+	mux.HandleFunc("PUT /api/config", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		if !user.CanAccessAllCameras(config.Inputs) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		if configFromEnv() {
+			writeJSONError(w, http.StatusConflict, "config is set with CREAMY_NVR_CONFIG and can't be replaced")
+			return
+		}
+		configBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "failed to read config")
+			return
+		}
+		if err := validateConfig(configBytes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := writeConfig(configBytes); err != nil {
+			logger.WithError(err).Error("failed to write config")
+			writeJSONError(w, http.StatusInternalServerError, "failed to write config")
+			return
+		}
+		logger.WithField("username", user.Username).Info("replaced config on request, restart to apply it")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /api/login", authenticator.HandleLogin)
+	mux.HandleFunc("POST /api/logout", authenticator.HandleLogout)
+	mux.HandleFunc("GET /api/me", authenticator.HandleMe)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, ApiV1Health{Status: "ok"}, true)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		health, ok := readiness(&config, streams, indexLoaded.Load())
+		writeHealth(w, health, ok)
 	})
-	mux.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir("./media"))))
+	mux.HandleFunc("GET /metrics", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, streams)
+	}))
+	mux.HandleFunc("GET /api/recordings", RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		q, err := parseRecordingsQuery(r.URL.Query())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// only copy out matching recordings while holding the lock, encoding happens afterwards
+		var (
+			page []Recording
+			next *recordingsCursor
+		)
+		recordingsLock.RLock()
+		for revIdx := len(recordings) - 1; revIdx >= 0; revIdx-- {
+			recording := recordings[revIdx]
+			if q.Cursor != nil && !q.Cursor.after(recording) {
+				continue
+			}
+			if !user.CanAccessCamera(recording.InputID) || !q.Matches(recording) {
+				continue
+			}
+			if q.Limit > 0 && len(page) == q.Limit {
+				last := page[len(page)-1]
+				next = &recordingsCursor{Start: last.Start, Path: last.Path}
+				break
+			}
+			page = append(page, recording)
+		}
+		recordingsLock.RUnlock()
+
+		locks, err := index.Locks()
+		if err != nil {
+			logger.WithError(err).Error("failed to load locks")
+			writeJSONError(w, http.StatusInternalServerError, "failed to load locks")
+			return
+		}
+		now := time.Now()
+		apiRecordings := make([]ApiV1Recording, len(page))
+		for i := range page {
+			input := streams[streamIdxMap[page[i].InputID]].Input
+			apiRecordings[i] = newApiV1Recording(page[i], input.Name)
+			apiRecordings[i].Lock = recordingLock(locks, input, page[i], now)
+		}
+		writeRecordingsPage(w, r, q, apiRecordings, next)
+	}))
+	mux.HandleFunc("GET /api/recordings/{id}", RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var (
+			recording Recording
+			found     bool
+		)
+		recordingsLock.RLock()
+		for i := range recordings {
+			if recordings[i].ID == r.PathValue("id") {
+				recording, found = recordings[i], true
+				break
+			}
+		}
+		recordingsLock.RUnlock()
+
+		if !found || !user.CanAccessCamera(recording.InputID) {
+			writeJSONError(w, http.StatusNotFound, "recording not found")
+			return
+		}
+		locks, err := index.Locks()
+		if err != nil {
+			logger.WithError(err).Error("failed to load locks")
+			writeJSONError(w, http.StatusInternalServerError, "failed to load locks")
+			return
+		}
+		input := streams[streamIdxMap[recording.InputID]].Input
+		apiRecording := newApiV1RecordingDetail(recording, input.Name)
+		apiRecording.Lock = recordingLock(locks, input, recording, time.Now())
+		writeJSON(w, apiRecording)
+	}))
+	mux.HandleFunc("GET /api/locks", RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		locks, err := index.Locks()
+		if err != nil {
+			logger.WithError(err).Error("failed to load locks")
+			writeJSONError(w, http.StatusInternalServerError, "failed to load locks")
+			return
+		}
+		now := time.Now()
+		apiLocks := []RecordingLock{}
+		for _, lock := range locks {
+			if user.CanAccessCamera(lock.StreamID) && !lock.Expired(now) {
+				apiLocks = append(apiLocks, lock)
+			}
+		}
+		writeJSON(w, apiLocks)
+	}))
+	mux.HandleFunc("POST /api/locks", RequireRole(RoleReviewer, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var lock RecordingLock
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&lock); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid lock: "+err.Error())
+			return
+		}
+
+		if lock.RecordingID != "" {
+			found := false
+			recordingsLock.RLock()
+			for i := range recordings {
+				if recordings[i].ID != lock.RecordingID {
+					continue
+				}
+				// a recording of another stream than the one requested isn't the one the lock is meant for
+				if lock.StreamID == "" || lock.StreamID == recordings[i].InputID {
+					found = true
+					lock.StreamID = recordings[i].InputID
+				}
+				break
+			}
+			recordingsLock.RUnlock()
+			if !found || !user.CanAccessCamera(lock.StreamID) {
+				writeJSONError(w, http.StatusNotFound, "recording not found")
+				return
+			}
+		}
+		if _, ok := streamIdxMap[lock.StreamID]; lock.StreamID != "" && (!ok || !user.CanAccessCamera(lock.StreamID)) {
+			writeJSONError(w, http.StatusNotFound, "stream not found")
+			return
+		}
+
+		now := time.Now()
+		if err := lock.validate(now); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if lock.ID, err = newLockID(); err != nil {
+			logger.WithError(err).Error("failed to generate lock id")
+			writeJSONError(w, http.StatusInternalServerError, "failed to generate lock id")
+			return
+		}
+		lock.CreatedBy = user.Username
+		lock.Created = now
+		if err := index.PutLock(lock); err != nil {
+			logger.WithError(err).Error("failed to save lock")
+			writeJSONError(w, http.StatusInternalServerError, "failed to save lock")
+			return
+		}
+		logger.WithField("stream", lock.StreamID).WithField("lock", lock.ID).WithField("username", user.Username).WithField("reason", lock.Reason).Info("locked recordings on request")
+		writeJSON(w, lock)
+	}))
+	mux.HandleFunc("DELETE /api/locks/{id}", RequireRole(RoleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		locks, err := index.Locks()
+		if err != nil {
+			logger.WithError(err).Error("failed to load locks")
+			writeJSONError(w, http.StatusInternalServerError, "failed to load locks")
+			return
+		}
+		var lock *RecordingLock
+		for i := range locks {
+			if locks[i].ID == r.PathValue("id") {
+				lock = &locks[i]
+				break
+			}
+		}
+		if lock == nil || !user.CanAccessCamera(lock.StreamID) {
+			writeJSONError(w, http.StatusNotFound, "lock not found")
+			return
+		}
+		if err := index.DeleteLock(lock.ID); err != nil {
+			logger.WithError(err).Error("failed to remove lock")
+			writeJSONError(w, http.StatusInternalServerError, "failed to remove lock")
+			return
+		}
+		logger.WithField("stream", lock.StreamID).WithField("lock", lock.ID).WithField("username", user.Username).Info("unlocked recordings on request")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mediaFileServer := http.StripPrefix("/media/", http.FileServer(http.Dir("./media")))
+	mux.Handle("/media/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only serve stream directories, not the index or anything else that ends up in media/
+		mediaPath := strings.TrimPrefix(path.Clean(r.URL.Path), "/media/")
+		inputID, _, _ := strings.Cut(mediaPath, "/")
+		if _, ok := streamIdxMap[inputID]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		// 404 instead of 403 so restricted users can't probe for files
+		if !UserFromContext(r.Context()).CanAccessMedia(mediaPath) {
+			http.NotFound(w, r)
+			return
+		}
+		mediaFileServer.ServeHTTP(w, r)
+	}))
 	mux.Handle("/cameras", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFileFS(w, r, sub, "index.html")
 	}))
@@ -852,11 +1526,68 @@ func main() {
 	mux.Handle("/live-view", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFileFS(w, r, sub, "index.html")
 	}))
+	mux.Handle("/login", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, sub, "index.html")
+	}))
 	mux.Handle("/", http.FileServerFS(sub))
 
-	if err := http.ListenAndServe(":3000", mux); err != nil {
-		logger.WithError(err).Error("http.ListenAndServe error")
+	servers, err := StartServers(ctx, config.Listen, authenticator.Middleware(mux), func(err error) {
+		logger.WithError(err).Error("http server error")
+		shutdown()
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("failed to start http server")
+	}
+
+	<-ctx.Done()
+	stopSignals() // a second signal kills us immediately
+	logger.WithField("timeout", config.ShutdownTimeout().String()).Info("shutting down")
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout())
+	defer cancelShutdown()
+
+	servers.Shutdown(shutdownCtx)
+
+	// recorders ask ffmpeg to finalize the current segment and report it as closed before returning
+	recordersWG.Wait()
+	<-loaderStopped
+	logger.Debug("recorders stopped")
+
+	drained := make(chan struct{})
+	go func() {
+		for _, closeQueues := range closeSegmentQueues {
+			closeQueues()
+		}
+		segmentQueuesWG.Wait()
+		close(performMotionDetection)
+		motionDetectionWorkersWG.Wait()
+		alerter.Wait()
+		webhooks.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		logger.Debug("thumbnail and motion detection queues and webhooks drained")
+	case <-shutdownCtx.Done():
+		logger.Warn("timed out waiting for thumbnail and motion detection queues and webhooks to drain, killing remaining work")
+		cancelWork()
+		<-drained
+	}
+
+	// wait for any in-progress prune
+	pruneLock.Lock()
+	defer pruneLock.Unlock()
+
+	close(stopRecordings)
+	<-recordingsStopped
+	if err := index.Close(); err != nil {
+		logger.WithError(err).Error("failed to close recording index")
 	}
+	if mqttClient != nil {
+		mqttClient.Close()
+	}
+
+	servers.Wait()
 	logger.Info("end of main")
 }
 
@@ -866,6 +1597,10 @@ type OpeningForWritingWriter struct {
 	parentWarn io.Writer
 	parentInfo io.Writer
 	buf        bytes.Buffer
+
+	// exitReason and exitMessage are set to the last error line that could explain why ffmpeg stopped
+	exitReason  string
+	exitMessage string
 }
 
 var exprSegmentWriting = regexp.MustCompile(`\[segment[^\]]+\] \[info\] Opening '([^']+\.mp4)' for writing`)
@@ -892,6 +1627,11 @@ func (w *OpeningForWritingWriter) onLine(p []byte) {
 		}
 	}
 
+	if reason := classifyFFmpegLine(str); reason != "" {
+		w.exitReason = reason
+		w.exitMessage = strings.TrimSpace(str)
+	}
+
 	if w.parentErr != nil {
 		if strings.HasPrefix(str, "[fatal]") || strings.HasPrefix(str, "[error]") {
 			w.parentErr.Write(p)
@@ -925,252 +1665,214 @@ func (w *OpeningForWritingWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func record(ctx context.Context, stream *Stream) {
+// closeSegment reports the currently-open segment as closed, if any.
+// It is called after the stream-capturing command exits, since no further segment will be opened to close it.
+func (s *Stream) closeSegment() {
+	segment := s.LastSegmentOpenedName.Load()
+	if segment == "" {
+		return
+	}
+	s.LastSegmentOpenedName.Store("")
+	if s.OnSegmentClosed != nil {
+		s.OnSegmentClosed(s.LastSegmentOpened.Load(), segment)
+	}
+	s.LastSegmentClosed.Store(time.Now())
+}
+
+// record runs the stream-capturing command until ctx is cancelled, restarting it with backoff when it stops.
+// When ctx is cancelled, the command is sent SIGINT so the current segment is finalized,
+// and is killed if it is still running after stopTimeout.
+func record(ctx context.Context, stream *Stream, stopTimeout time.Duration) {
 	logger := logger.WithField("stream", stream.Input.ID)
 	loggerErr := logger.WriterLevel(logrus.ErrorLevel)
 	loggerWarn := logger.WriterLevel(logrus.WarnLevel)
 	loggerInfo := logger.WriterLevel(logrus.DebugLevel)
 
-	newCmd := func() *exec.Cmd {
-		cmd := exec.CommandContext(ctx, "./rtsp-to-hls.sh")
+	var killed atomic.Bool
+	// newCmd prepares the stream-capturing command.
+	// The returned exited func must be called once the command has been waited for,
+	// so restarting or stopping afterwards can't signal a process group that reused its PGID.
+	newCmd := func() (cmd *exec.Cmd, stderr *OpeningForWritingWriter, exited func()) {
+		cmd = exec.CommandContext(ctx, "ffmpeg", stream.Input.ffmpegArgs()...)
 		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pgid: 0}
-		cmd.Env = append(
-			cmd.Env,
-			"RTSP_SOURCE="+stream.Input.URL,
-			"RTSP_NAME="+stream.Input.ID,
-			"RTSP_EXTRA_ARGS="+stream.Input.ExtraFFMPEGArgs,
-		)
+		cmd.Cancel = func() error {
+			// ffmpeg finalizes its outputs when interrupted
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+		}
+		cmd.WaitDelay = stopTimeout
 		// ffmpeg is writing all output to stderr for me
-		cmd.Stderr = &OpeningForWritingWriter{
+		stderr = &OpeningForWritingWriter{
 			stream:     stream,
 			parentErr:  loggerErr,
 			parentWarn: loggerWarn,
 			parentInfo: loggerInfo,
 		}
-		var cmdRestartLock sync.Mutex
+		cmd.Stderr = stderr
+		var (
+			cmdRestartLock sync.Mutex
+			cmdExited      bool
+			killTimer      *time.Timer
+		)
 		stream.RestartRecording.Store(func() {
 			cmdRestartLock.Lock()
 			defer cmdRestartLock.Unlock()
-			if cmd.Process != nil {
+			if cmd.Process != nil && !cmdExited {
+				killed.Store(true)
 				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 				logger.Info("performed kill")
 			} else {
 				logger.Warn("restart recording was requested, but process is nil")
 			}
 		})
-		return cmd
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			stream.Active.Store(false)
-			stream.LastRestart.Store(time.Now())
-
-			cmd := newCmd()
-			if err := cmd.Start(); err != nil {
-				stream.LastErr.Store(err)
-				logger.WithError(err).Error("failed to start cmd")
-				continue
+		stream.StopRecording.Store(func() {
+			cmdRestartLock.Lock()
+			defer cmdRestartLock.Unlock()
+			if cmd.Process != nil && !cmdExited {
+				pid := cmd.Process.Pid
+				syscall.Kill(-pid, syscall.SIGINT)
+				if killTimer == nil {
+					killTimer = time.AfterFunc(stopTimeout, func() {
+						cmdRestartLock.Lock()
+						defer cmdRestartLock.Unlock()
+						if !cmdExited {
+							syscall.Kill(-pid, syscall.SIGKILL)
+						}
+					})
+				}
+				logger.Info("performed interrupt")
+			} else {
+				logger.Warn("stop recording was requested, but process is nil")
 			}
-
-			stream.Active.Store(true)
-			logger.Info("stream active")
-			if err := cmd.Wait(); err != nil {
-				stream.LastErr.Store(err)
-				logger.WithError(err).Error("cmd stopped with error")
+		})
+		exited = func() {
+			cmdRestartLock.Lock()
+			defer cmdRestartLock.Unlock()
+			cmdExited = true
+			if killTimer != nil {
+				killTimer.Stop()
 			}
-			stream.Active.Store(false)
-			logger.Info("stream inactive")
 		}
-
-		time.Sleep(30 * time.Second)
-	}
-}
-
-type motion struct {
-	Time  int // seconds
-	Score int // 0-100
-}
-
-// var motionTimeRegex = regexp.MustCompile(`frame:(\d+) +pts:(\d+) +pts_time:([\d\.]+)`)
-// var motionScoreRegex = regexp.MustCompile(`lavfi.scene_score=([\d\.]+)`)
-var motionTimeRegexMpDecimate = regexp.MustCompile(`showinfo.+ pts_time:([\d\.]+)`)
-
-func motionTimeline(ctx context.Context, fpath string, minScore int) ([]motion, error) {
-	probeCtx, probeCancel := context.WithTimeout(ctx, time.Minute)
-	defer probeCancel()
-	ffprobe := exec.CommandContext(
-		probeCtx,
-		"ffprobe", fpath,
-		"-v", "quiet",
-		"-of", "json",
-		"-show_entries", "stream",
-	)
-	data, err := ffprobe.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to motion ffprobe %v: %v", fpath, err)
-	}
-
-	type ffprobeOutput struct {
-		Streams []struct {
-			// there's also "r_frame_rate", but I think it might be more work to parse values like "500000/33333"
-			CodecType string `json:"codec_type"`
-			Duration  string `json:"duration"`
-			NbFrames  string `json:"nb_frames"`
-		} `json:"streams"`
-	}
-	var parsed ffprobeOutput
-	if err := json.Unmarshal(data, &parsed); err != nil {
-		return nil, fmt.Errorf("failed to parse motion ffprobe output %v: %v", string(data), err)
+		return cmd, stderr, exited
 	}
 
-	var fps int
-	for _, output := range parsed.Streams {
-		if output.CodecType != "video" {
-			continue
-		}
-		durationF, err := strconv.ParseFloat(output.Duration, 64)
-		if err != nil {
-			continue
-		}
-		durationI := int(durationF)
-		if durationI < 1 {
-			continue
+	// run starts the stream-capturing command and waits for it to stop.
+	// It returns true if the command recorded for long enough to be considered healthy.
+	run := func() bool {
+		if err := stream.Input.prepareRecordingDirectories(); err != nil {
+			stream.LastErr.Store(err)
+			stream.LastErrReason.Store(ExitReasonStartFailed)
+			stream.LastErrMessage.Store("")
+			logger.WithError(err).Error("failed to prepare recording directories")
+			return false
 		}
-		nbFramesI, err := strconv.ParseInt(output.NbFrames, 10, 64)
-		if err != nil {
-			continue
+
+		killed.Store(false)
+		cmd, stderr, exited := newCmd()
+		logger.WithField("args", cmd.Args).Debug("starting cmd")
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			stream.LastErr.Store(err)
+			stream.LastErrReason.Store(ExitReasonStartFailed)
+			stream.LastErrMessage.Store("")
+			logger.WithError(err).Error("failed to start cmd")
+			return false
 		}
-		if nbFramesI < 1 {
-			continue
+
+		stream.Active.Store(true)
+		logger.Info("stream active")
+		publishStreamEvent(EventStreamActive, stream)
+		// SetPaused only stops active streams, so a pause while ffmpeg was starting must be handled here
+		if stream.Paused.Load() {
+			stream.StopRecording.Load()()
 		}
-		fps = int(nbFramesI) / durationI
-		if fps < 1 {
-			fps = 1
+		err := cmd.Wait()
+		// make sure nothing from the process group outlives ffmpeg
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		exited()
+		stream.Active.Store(false)
+		stream.closeSegment()
+
+		if ctx.Err() == nil && !stream.Paused.Load() {
+			reason := stderr.exitReason
+			if reason == "" {
+				if killed.Load() {
+					reason = ExitReasonKilled
+				} else {
+					reason = ExitReasonExited
+				}
+			}
+			if err == nil {
+				err = errors.New("cmd exited")
+			}
+			stream.LastErr.Store(err)
+			stream.LastErrReason.Store(reason)
+			stream.LastErrMessage.Store(stderr.exitMessage)
+			logger.WithError(err).WithField("reason", reason).WithField("message", stderr.exitMessage).Error("cmd stopped")
 		}
-	}
-	if fps < 1 {
-		// todo: we can probably continue without fps
-		return nil, fmt.Errorf("failed to determine fps of %v: determined fps<1 from %v", fpath, string(data))
-	}
-	// todo: if ~1 value per second is too many, we can re-evaluate, or merge/avg/downsample them later here
-	// todo: configurable scene motion value
-
-	// motionCtx, motionCancel := context.WithTimeout(ctx, time.Minute)
-	// defer motionCancel()
-	// ffmpeg := exec.CommandContext(
-	// 	motionCtx,
-	// 	"ffmpeg",
-	// 	"-i", fpath,
-	// 	"-vf", fmt.Sprintf(`select='not(mod(n\,%v))',select='gte(scene\,0.02)',metadata=print`, fps),
-	// 	"-an",
-	// 	"-f", "null",
-	// 	"-",
-	// )
-	// data, err = ffmpeg.CombinedOutput()
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to motion ffmpeg %v: %v (%v)", fpath, err, ffmpeg.Args)
-	// }
-
-	// ms := []motion{}
-
-	// scanner := bufio.NewScanner(bytes.NewReader(data))
-	// var (
-	// 	m        motion
-	// 	hasTime  bool
-	// 	hasScore bool
-	// )
-	// for scanner.Scan() {
-	// 	line := scanner.Text()
-	// 	timeMatch := motionTimeRegex.FindStringSubmatch(line)
-	// 	if timeMatch != nil {
-	// 		timeMatchF, err := strconv.ParseFloat(timeMatch[3], 64)
-	// 		if err != nil {
-	// 			// todo: warn
-	// 			continue
-	// 		}
-	// 		m.Time = int(timeMatchF)
-	// 		hasTime = true
-	// 		continue
-	// 	}
-	// 	scoreMatch := motionScoreRegex.FindStringSubmatch(line)
-	// 	if scoreMatch != nil {
-	// 		scoreMatchF, err := strconv.ParseFloat(scoreMatch[1], 64)
-	// 		if err != nil {
-	// 			// todo: warn
-	// 			continue
-	// 		}
-	// 		m.Score = int(scoreMatchF * 100)
-	// 		hasScore = true
-	// 	}
-
-	// 	if hasTime && hasScore {
-	// 		hasTime = false
-	// 		hasScore = false
-	// 		ms = append(ms, m)
-	// 		m = motion{}
-	// 	}
-	// }
-
-	// todo: this works better for motion detection imo, but it is heavy
-	motionCtx, motionCancel := context.WithTimeout(ctx, 3*time.Minute)
-	defer motionCancel()
-	ffmpeg := exec.CommandContext(
-		motionCtx,
-		"ffmpeg",
-		"-i", fpath,
-		"-vf", "mpdecimate=hi=2000:lo=1000:frac=0.33,showinfo", // todo: tune
-		"-an",
-		"-f", "null",
-		"-",
-	)
-	data, err = ffmpeg.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("failed to motion ffmpeg %v: %v (%v)", fpath, err, ffmpeg.Args)
+		logger.Info("stream inactive")
+
+		return time.Since(started) >= time.Minute && stream.LastFileOpened.Load().After(started)
 	}
 
-	ms := []motion{}
+	policy := stream.Input.restartPolicy()
+	for first := true; ; first = false {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
 
-	secondMotionCounters := map[int]int{}
+		if stream.Paused.Load() {
+			logger.Info("recording paused")
+			publishStreamEvent(EventStreamPaused, stream)
+			for stream.Paused.Load() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-stream.pauseChanged:
+				}
+			}
+			logger.Info("recording resumed")
+			publishStreamEvent(EventStreamResumed, stream)
+			policy.reset()
+			stream.ConsecutiveFailures.Store(0)
+			stream.NextRestart.Store(time.Time{})
+		}
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		line := scanner.Text()
-		timeMatch := motionTimeRegexMpDecimate.FindStringSubmatch(line)
-		if timeMatch == nil {
-			continue
+		stream.Active.Store(false)
+		stream.LastRestart.Store(time.Now())
+		if !first {
+			stream.Restarts.Add(1)
+			publishStreamEvent(EventStreamRestart, stream)
 		}
-		timeMatchF, err := strconv.ParseFloat(timeMatch[1], 64)
-		if err != nil {
-			// todo: warn
+
+		if run() {
+			policy.reset()
+		}
+		if stream.Paused.Load() {
 			continue
 		}
-		timeMatchI := int(timeMatchF)
 
-		ctr := secondMotionCounters[timeMatchI]
-		ctr++
-		secondMotionCounters[timeMatchI] = ctr
-	}
-
-	for second, ctr := range secondMotionCounters {
-		score := int((float32(ctr) / float32(fps)) * 100)
-		if score > 100 {
-			score = 100
+		delay := policy.next()
+		stream.ConsecutiveFailures.Store(policy.Failures())
+		stream.NextRestart.Store(time.Now().Add(delay))
+		publishStreamEvent(EventStreamInactive, stream)
+		if ctx.Err() == nil {
+			logger.WithField("delay", delay.String()).WithField("consecutive-failures", policy.Failures()).Info("restarting stream after delay")
 		}
-		if score < minScore {
-			continue
+
+		// pausing skips the rest of the delay
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		case <-stream.pauseChanged:
 		}
-		ms = append(ms, motion{
-			Time:  second,
-			Score: score,
-		})
 	}
-	sort.Slice(ms, func(i, j int) bool {
-		return ms[i].Time < ms[j].Time
-	})
+}
 
-	return ms, nil
+type motion struct {
+	Time  int            // seconds
+	Score int            // 0-100
+	Zones map[string]int `json:",omitempty"` // 0-100 per motion zone name
 }
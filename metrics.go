@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricVec is a counter or gauge with labels, exposed in the Prometheus text format
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec(name, metricType, help string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		values:     map[string]float64{},
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// formatLabels renders label pairs like ("stream", "doorbell", "kind", "recording") as `stream="doorbell",kind="recording"`
+func formatLabels(labels ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+func (v *metricVec) Add(delta float64, labels ...string) {
+	key := formatLabels(labels...)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] += delta
+}
+
+func (v *metricVec) Set(value float64, labels ...string) {
+	key := formatLabels(labels...)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] = value
+}
+
+func (v *metricVec) writeTo(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeMetricHeader(w, v.name, v.metricType, v.help)
+	for _, key := range keys {
+		writeMetricSample(w, v.name, key, v.values[key])
+	}
+}
+
+// histogram is an unlabeled Prometheus histogram
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	lock   sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets ...float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeMetricHeader(w, h.name, "histogram", h.help)
+	for i, bucket := range h.buckets {
+		writeMetricSample(w, h.name+"_bucket", formatLabels("le", strconv.FormatFloat(bucket, 'g', -1, 64)), float64(h.counts[i]))
+	}
+	writeMetricSample(w, h.name+"_bucket", formatLabels("le", "+Inf"), float64(h.count))
+	writeMetricSample(w, h.name+"_sum", "", h.sum)
+	writeMetricSample(w, h.name+"_count", "", float64(h.count))
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, metricType)
+}
+
+func writeMetricSample(w io.Writer, name, labels string, value float64) {
+	formatted := strconv.FormatFloat(value, 'g', -1, 64)
+	if math.IsInf(value, 1) {
+		formatted = "+Inf"
+	}
+	if labels == "" {
+		fmt.Fprintf(w, "%v %v\n", name, formatted)
+	} else {
+		fmt.Fprintf(w, "%v{%v} %v\n", name, labels, formatted)
+	}
+}
+
+// metrics are updated throughout the application and exposed at /metrics.
+// Per-stream state is read from each Stream when scraped instead.
+var metrics = struct {
+	MotionDetectionQueueDepth  atomic.Int64
+	MotionDetectionWorkersBusy atomic.Int64
+	MotionDetectionWorkers     atomic.Int64
+	DiskFreeBytes              atomic.Int64
+	MotionDetectionDuration    *histogram
+	MotionDetectionJobs        *metricVec
+	ThumbnailFailures          *metricVec
+	PruneDeletions             *metricVec
+	DirectoryBytes             *metricVec
+	WebhookDeliveries          *metricVec
+}{
+	MotionDetectionDuration: newHistogram("creamy_nvr_motion_detection_duration_seconds", "Duration of motion detection jobs.", 1, 5, 10, 30, 60, 120, 240),
+	MotionDetectionJobs:     newMetricVec("creamy_nvr_motion_detection_jobs_total", "counter", "Motion detection jobs performed, by result."),
+	ThumbnailFailures:       newMetricVec("creamy_nvr_thumbnail_failures_total", "counter", "Thumbnails that failed to generate."),
+	PruneDeletions:          newMetricVec("creamy_nvr_prune_deletions_total", "counter", "Files deleted by pruning, by kind and reason."),
+	DirectoryBytes:          newMetricVec("creamy_nvr_directory_bytes", "gauge", "Size of each stream's recording and stream segment directory, as of the last prune."),
+	WebhookDeliveries:       newMetricVec("creamy_nvr_webhook_deliveries_total", "counter", "Webhook deliveries, by result."),
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format
+func writeMetrics(w io.Writer, streams []Stream) {
+	boolToFloat := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	type streamMetric struct {
+		name       string
+		metricType string
+		help       string
+		value      func(stream *Stream) float64
+	}
+	streamMetrics := []streamMetric{
+		{"creamy_nvr_stream_active", "gauge", "1 if the stream-capturing command is running.", func(s *Stream) float64 { return boolToFloat(s.Active.Load()) }},
+		{"creamy_nvr_stream_in_err", "gauge", "1 if the stream is not running or any of its health checks are failing.", func(s *Stream) float64 { return boolToFloat(s.InErr()) }},
+		{"creamy_nvr_stream_last_restart_in_err", "gauge", "1 if the stream restarted recently.", func(s *Stream) float64 { return boolToFloat(s.LastRestartInErr.Load()) }},
+		{"creamy_nvr_stream_last_file_opened_in_err", "gauge", "1 if the stream has not opened a file recently.", func(s *Stream) float64 { return boolToFloat(s.LastFileOpenedInErr.Load()) }},
+		{"creamy_nvr_stream_last_segment_opened_in_err", "gauge", "1 if the stream has not opened a recording recently.", func(s *Stream) float64 { return boolToFloat(s.LastSegmentOpenedInErr.Load()) }},
+		{"creamy_nvr_stream_playlist_stalled_in_err", "gauge", "1 if the stream's live playlist has not been written recently.", func(s *Stream) float64 { return boolToFloat(s.PlaylistStalledInErr.Load()) }},
+		{"creamy_nvr_stream_segment_stalled_in_err", "gauge", "1 if the stream's current recording has not grown recently.", func(s *Stream) float64 { return boolToFloat(s.SegmentStalledInErr.Load()) }},
+		{"creamy_nvr_stream_disk_full", "gauge", "1 if free disk space is below the low-water mark.", func(s *Stream) float64 { return boolToFloat(s.DiskFull.Load()) }},
+		{"creamy_nvr_stream_seconds_since_last_segment_closed", "gauge", "Seconds since the stream last finished a recording.", func(s *Stream) float64 { return time.Since(s.LastSegmentClosed.Load()).Seconds() }},
+		{"creamy_nvr_stream_seconds_since_last_file_opened", "gauge", "Seconds since the stream last opened a file.", func(s *Stream) float64 { return time.Since(s.LastFileOpened.Load()).Seconds() }},
+		{"creamy_nvr_stream_restarts_total", "counter", "Times the stream-capturing command has been restarted.", func(s *Stream) float64 { return float64(s.Restarts.Load()) }},
+		{"creamy_nvr_stream_consecutive_failures", "gauge", "Times the stream-capturing command has stopped since it last ran healthily.", func(s *Stream) float64 { return float64(s.ConsecutiveFailures.Load()) }},
+	}
+	for _, m := range streamMetrics {
+		writeMetricHeader(w, m.name, m.metricType, m.help)
+		for i := range streams {
+			writeMetricSample(w, m.name, formatLabels("stream", streams[i].Input.ID), m.value(&streams[i]))
+		}
+	}
+
+	metrics.DirectoryBytes.writeTo(w)
+	if free := metrics.DiskFreeBytes.Load(); free > 0 {
+		writeMetricHeader(w, "creamy_nvr_disk_free_bytes", "gauge", "Free space of the filesystem media/ is on, as of the last disk space check.")
+		writeMetricSample(w, "creamy_nvr_disk_free_bytes", "", float64(free))
+	}
+
+	writeMetricHeader(w, "creamy_nvr_motion_detection_queue_depth", "gauge", "Recordings waiting for motion detection.")
+	writeMetricSample(w, "creamy_nvr_motion_detection_queue_depth", "", float64(metrics.MotionDetectionQueueDepth.Load()))
+	writeMetricHeader(w, "creamy_nvr_motion_detection_workers_busy", "gauge", "Motion detection workers currently performing motion detection.")
+	writeMetricSample(w, "creamy_nvr_motion_detection_workers_busy", "", float64(metrics.MotionDetectionWorkersBusy.Load()))
+	writeMetricHeader(w, "creamy_nvr_motion_detection_workers", "gauge", "Motion detection workers.")
+	writeMetricSample(w, "creamy_nvr_motion_detection_workers", "", float64(metrics.MotionDetectionWorkers.Load()))
+	metrics.MotionDetectionDuration.writeTo(w)
+	metrics.MotionDetectionJobs.writeTo(w)
+	metrics.ThumbnailFailures.writeTo(w)
+	metrics.PruneDeletions.writeTo(w)
+	metrics.WebhookDeliveries.writeTo(w)
+}
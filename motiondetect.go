@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	motionDetectorMpdecimate = "mpdecimate"
+	motionDetectorScene      = "scene"
+	motionDetectorPixelDiff  = "pixeldiff"
+	motionDetectorCommand    = "command"
+)
+
+// MotionDetectorInfo describes how motion was detected, and is saved with the results.
+// Results are detected again if this differs from the input's current settings.
+type MotionDetectorInfo struct {
+	Algorithm string `json:"algorithm"`
+	// AlgorithmVersion should be bumped whenever an algorithm's output changes for the same input
+	AlgorithmVersion int `json:"algorithm_version"`
+	MinimumScore     int `json:"minimum_score"`
+	// Params are the detector's settings that were changed from their defaults, as JSON
+	Params string `json:"params,omitempty"`
+}
+
+// MotionDetector finds motion in recordings, scoring each second with motion from 0 to 100
+type MotionDetector interface {
+	Info() MotionDetectorInfo
+	Detect(ctx context.Context, fpath string) ([]motion, error)
+}
+
+type MotionDetectionConfig struct {
+	// Detector is the algorithm used to detect motion in recordings:
+	// "mpdecimate", "scene", "pixeldiff" or "command".
+	// Defaults to "pixeldiff" if the input has motion zones, otherwise "mpdecimate".
+	Detector string `json:"detector"`
+
+	Mpdecimate MpdecimateConfig    `json:"mpdecimate"`
+	Scene      SceneConfig         `json:"scene"`
+	Command    MotionCommandConfig `json:"command"`
+}
+
+type MpdecimateConfig struct {
+	// Hi, Lo and Frac are passed to ffmpeg's mpdecimate filter, see https://ffmpeg.org/ffmpeg-filters.html#mpdecimate.
+	// Frames that mpdecimate doesn't drop count as motion.
+	// Default to 2000, 1000 and 0.33.
+	Hi   int     `json:"hi,omitempty"`
+	Lo   int     `json:"lo,omitempty"`
+	Frac float64 `json:"frac,omitempty"`
+}
+
+type SceneConfig struct {
+	// FPS is how many frames are compared each second.
+	// Defaults to 1.
+	FPS int `json:"fps,omitempty"`
+}
+
+type MotionCommandConfig struct {
+	// Command is run with the recording's path appended, and must print its motion to stdout as JSON,
+	// like [{"t": 12, "s": 30}], where t is seconds into the recording and s is the score from 0 to 100
+	Command []string `json:"command,omitempty"`
+	// TimeoutSeconds is how long the command can run.
+	// Defaults to 240.
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+}
+
+// DetectorName is Detector with the default applied
+func (i Input) DetectorName() string {
+	if i.MotionDetection.Detector != "" {
+		return i.MotionDetection.Detector
+	}
+	if len(i.MotionZones) > 0 {
+		return motionDetectorPixelDiff
+	}
+	return motionDetectorMpdecimate
+}
+
+// MotionDetector returns the detector configured for the input's recordings
+func (i Input) MotionDetector() MotionDetector {
+	switch i.DetectorName() {
+	case motionDetectorScene:
+		return sceneDetector{config: i.MotionDetection.Scene, minScore: i.MotionMinimumScore()}
+	case motionDetectorPixelDiff:
+		return pixelDiffDetector{config: i.PixelDiff, zones: i.MotionZones}
+	case motionDetectorCommand:
+		return commandDetector{config: i.MotionDetection.Command, minScore: i.MotionMinimumScore()}
+	default:
+		return mpdecimateDetector{config: i.MotionDetection.Mpdecimate, minScore: i.MotionMinimumScore()}
+	}
+}
+
+// validateMotionDetection makes sure the detector exists and can be used with the input's motion zones
+func (i Input) validateMotionDetection() error {
+	switch i.DetectorName() {
+	case motionDetectorMpdecimate, motionDetectorScene, motionDetectorPixelDiff:
+	case motionDetectorCommand:
+		if len(i.MotionDetection.Command.Command) == 0 {
+			return fmt.Errorf("the %v motion detector needs a command", motionDetectorCommand)
+		}
+	default:
+		return fmt.Errorf("unknown motion detector %v", i.MotionDetection.Detector)
+	}
+	if len(i.MotionZones) > 0 && i.DetectorName() != motionDetectorPixelDiff {
+		return fmt.Errorf("motion zones need the %v motion detector, not %v", motionDetectorPixelDiff, i.DetectorName())
+	}
+	return i.validateMotionZones()
+}
+
+// motionDetectorParams encodes settings as JSON, leaving out defaults so adding a setting doesn't detect everything again
+func motionDetectorParams(settings any) string {
+	data, err := json.Marshal(settings)
+	if err != nil || string(data) == "{}" || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// probeFPS returns the average frame rate of the recording's video
+func probeFPS(ctx context.Context, fpath string) (int, error) {
+	probeCtx, probeCancel := context.WithTimeout(ctx, time.Minute)
+	defer probeCancel()
+	ffprobe := exec.CommandContext(
+		probeCtx,
+		"ffprobe", fpath,
+		"-v", "quiet",
+		"-of", "json",
+		"-show_entries", "stream",
+	)
+	data, err := ffprobe.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to motion ffprobe %v: %v", fpath, err)
+	}
+
+	type ffprobeOutput struct {
+		Streams []struct {
+			// there's also "r_frame_rate", but I think it might be more work to parse values like "500000/33333"
+			CodecType string `json:"codec_type"`
+			Duration  string `json:"duration"`
+			NbFrames  string `json:"nb_frames"`
+		} `json:"streams"`
+	}
+	var parsed ffprobeOutput
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return 0, fmt.Errorf("failed to parse motion ffprobe output %v: %v", string(data), err)
+	}
+
+	var fps int
+	for _, output := range parsed.Streams {
+		if output.CodecType != "video" {
+			continue
+		}
+		durationF, err := strconv.ParseFloat(output.Duration, 64)
+		if err != nil {
+			continue
+		}
+		durationI := int(durationF)
+		if durationI < 1 {
+			continue
+		}
+		nbFramesI, err := strconv.ParseInt(output.NbFrames, 10, 64)
+		if err != nil {
+			continue
+		}
+		if nbFramesI < 1 {
+			continue
+		}
+		fps = int(nbFramesI) / durationI
+		if fps < 1 {
+			fps = 1
+		}
+	}
+	if fps < 1 {
+		// todo: we can probably continue without fps
+		return 0, fmt.Errorf("failed to determine fps of %v: determined fps<1 from %v", fpath, string(data))
+	}
+	return fps, nil
+}
+
+// sortedMotion turns the scores of each second into motion, leaving out seconds scoring less than minScore
+func sortedMotion(scores map[int]int, minScore int) []motion {
+	ms := []motion{}
+	for second, score := range scores {
+		score = min(score, 100)
+		if score < minScore {
+			continue
+		}
+		ms = append(ms, motion{
+			Time:  second,
+			Score: score,
+		})
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Time < ms[j].Time
+	})
+	return ms
+}
+
+// mpdecimateDetector scores each second by the percentage of frames mpdecimate considers different from the previous one
+type mpdecimateDetector struct {
+	config   MpdecimateConfig
+	minScore int
+}
+
+func (d mpdecimateDetector) Info() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        motionDetectorMpdecimate,
+		AlgorithmVersion: 1,
+		MinimumScore:     d.minScore,
+		Params:           motionDetectorParams(d.config),
+	}
+}
+
+var motionTimeRegexMpDecimate = regexp.MustCompile(`showinfo.+ pts_time:([\d\.]+)`)
+
+func (d mpdecimateDetector) Detect(ctx context.Context, fpath string) ([]motion, error) {
+	fps, err := probeFPS(ctx, fpath)
+	if err != nil {
+		return nil, err
+	}
+	// todo: if ~1 value per second is too many, we can re-evaluate, or merge/avg/downsample them later here
+
+	hi, lo, frac := d.config.Hi, d.config.Lo, d.config.Frac
+	if hi <= 0 {
+		hi = 2000
+	}
+	if lo <= 0 {
+		lo = 1000
+	}
+	if frac <= 0 {
+		frac = 0.33
+	}
+
+	// this works better for motion detection than scene scores imo, but it is heavy
+	motionCtx, motionCancel := context.WithTimeout(ctx, 3*time.Minute)
+	defer motionCancel()
+	ffmpeg := exec.CommandContext(
+		motionCtx,
+		"ffmpeg",
+		"-i", fpath,
+		"-vf", fmt.Sprintf("mpdecimate=hi=%v:lo=%v:frac=%v,showinfo", hi, lo, frac),
+		"-an",
+		"-f", "null",
+		"-",
+	)
+	data, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to motion ffmpeg %v: %v (%v)", fpath, err, ffmpeg.Args)
+	}
+
+	secondMotionCounters := map[int]int{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		timeMatch := motionTimeRegexMpDecimate.FindStringSubmatch(line)
+		if timeMatch == nil {
+			continue
+		}
+		timeMatchF, err := strconv.ParseFloat(timeMatch[1], 64)
+		if err != nil {
+			// todo: warn
+			continue
+		}
+		secondMotionCounters[int(timeMatchF)]++
+	}
+
+	scores := map[int]int{}
+	for second, ctr := range secondMotionCounters {
+		scores[second] = int((float32(ctr) / float32(fps)) * 100)
+	}
+	return sortedMotion(scores, d.minScore), nil
+}
+
+// sceneDetector scores each second by ffmpeg's scene change score between sampled frames
+type sceneDetector struct {
+	config   SceneConfig
+	minScore int
+}
+
+func (d sceneDetector) Info() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        motionDetectorScene,
+		AlgorithmVersion: 1,
+		MinimumScore:     d.minScore,
+		Params:           motionDetectorParams(d.config),
+	}
+}
+
+var (
+	motionTimeRegexScene  = regexp.MustCompile(`frame:\d+ +pts:\d+ +pts_time:([\d\.]+)`)
+	motionScoreRegexScene = regexp.MustCompile(`lavfi.scene_score=([\d\.]+)`)
+)
+
+func (d sceneDetector) Detect(ctx context.Context, fpath string) ([]motion, error) {
+	fps := d.config.FPS
+	if fps <= 0 {
+		fps = 1
+	}
+
+	motionCtx, motionCancel := context.WithTimeout(ctx, 3*time.Minute)
+	defer motionCancel()
+	ffmpeg := exec.CommandContext(
+		motionCtx,
+		"ffmpeg",
+		"-i", fpath,
+		"-vf", fmt.Sprintf(`fps=%v,select='gte(scene\,%v)',metadata=print`, fps, float64(max(d.minScore, 0))/100),
+		"-an",
+		"-f", "null",
+		"-",
+	)
+	data, err := ffmpeg.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to motion ffmpeg %v: %v (%v)", fpath, err, ffmpeg.Args)
+	}
+
+	scores := map[int]int{}
+
+	// metadata=print logs the time of each selected frame, followed by its score
+	second := -1
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if timeMatch := motionTimeRegexScene.FindStringSubmatch(line); timeMatch != nil {
+			timeMatchF, err := strconv.ParseFloat(timeMatch[1], 64)
+			if err != nil {
+				second = -1
+				continue
+			}
+			second = int(timeMatchF)
+			continue
+		}
+		scoreMatch := motionScoreRegexScene.FindStringSubmatch(line)
+		if scoreMatch == nil || second < 0 {
+			continue
+		}
+		scoreMatchF, err := strconv.ParseFloat(scoreMatch[1], 64)
+		if err != nil {
+			continue
+		}
+		scores[second] = max(scores[second], int(scoreMatchF*100))
+		second = -1
+	}
+
+	return sortedMotion(scores, d.minScore), nil
+}
+
+// pixelDiffDetector scores recordings like live motion detection does, see pixelDiffTimeline
+type pixelDiffDetector struct {
+	config PixelDiffConfig
+	zones  []MotionZone
+}
+
+func (d pixelDiffDetector) Info() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        motionDetectorPixelDiff,
+		AlgorithmVersion: pixelDiffAlgorithmVersion,
+		MinimumScore:     d.config.MinScore(),
+		Params:           pixelDiffParams(d.config, d.zones),
+	}
+}
+
+func (d pixelDiffDetector) Detect(ctx context.Context, fpath string) ([]motion, error) {
+	motionCtx, motionCancel := context.WithTimeout(ctx, 4*time.Minute)
+	defer motionCancel()
+	return pixelDiffTimeline(motionCtx, fpath, d.config, d.zones)
+}
+
+// commandDetector runs an external program, see MotionCommandConfig
+type commandDetector struct {
+	config   MotionCommandConfig
+	minScore int
+}
+
+func (d commandDetector) Info() MotionDetectorInfo {
+	return MotionDetectorInfo{
+		Algorithm:        motionDetectorCommand,
+		AlgorithmVersion: 1,
+		MinimumScore:     d.minScore,
+		// the timeout doesn't change the results, so changing it mustn't detect motion in every recording again
+		Params: motionDetectorParams(MotionCommandConfig{Command: d.config.Command}),
+	}
+}
+
+func (d commandDetector) Detect(ctx context.Context, fpath string) ([]motion, error) {
+	timeout := 4 * time.Minute
+	if d.config.TimeoutSeconds > 0 {
+		timeout = time.Duration(d.config.TimeoutSeconds) * time.Second
+	}
+	motionCtx, motionCancel := context.WithTimeout(ctx, timeout)
+	defer motionCancel()
+
+	args := append(append([]string{}, d.config.Command[1:]...), fpath)
+	cmd := exec.CommandContext(motionCtx, d.config.Command[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run motion command on %v: %v (%v)", fpath, err, stderr.String())
+	}
+
+	var results []ApiV1Motion
+	if err := json.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse motion command output for %v: %v", fpath, err)
+	}
+	ms := []motion{}
+	for _, result := range results {
+		if result.Time < 0 || result.Score < d.minScore {
+			continue
+		}
+		ms = append(ms, motion{Time: result.Time, Score: min(result.Score, 100), Zones: result.Zones})
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Time < ms[j].Time
+	})
+	return ms, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+type MotionEventsConfig struct {
+	// GapSeconds is how long there can be no motion before a motion event ends.
+	// Motion continuing across recordings is part of the same event.
+	// Defaults to 10.
+	GapSeconds int `json:"gap_seconds"`
+	// MinimumDurationSeconds leaves out motion events shorter than this, like a single second of noise.
+	// Defaults to 0, keeping every event.
+	MinimumDurationSeconds int `json:"minimum_duration_seconds"`
+}
+
+// Gap is GapSeconds with the default applied
+func (c MotionEventsConfig) Gap() time.Duration {
+	if c.GapSeconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(c.GapSeconds) * time.Second
+}
+
+// MinimumDuration is MinimumDurationSeconds as a duration
+func (c MotionEventsConfig) MinimumDuration() time.Duration {
+	return time.Duration(max(c.MinimumDurationSeconds, 0)) * time.Second
+}
+
+// ApiV1MotionEvent is motion merged from the per-second motion samples of one or more recordings
+type ApiV1MotionEvent struct {
+	StreamID string    `json:"stream_id"`
+	Start    time.Time `json:"start"`
+	// End is the end of the last second with motion
+	End       time.Time `json:"end"`
+	PeakTime  time.Time `json:"peak_time"`
+	PeakScore int       `json:"peak_score"`
+	// PeakZones is the highest score of each motion zone during the event
+	PeakZones map[string]int `json:"peak_zones,omitempty"`
+	// RecordingIDs are the recordings the event's motion was seen in, oldest first
+	RecordingIDs []string `json:"recording_ids"`
+}
+
+// motionSample is a motion sample with the absolute time of its second
+type motionSample struct {
+	time        time.Time
+	score       int
+	zones       map[string]int
+	recordingID string
+}
+
+// mergeMotionEvents merges the motion samples of the input's recordings into events.
+// Samples are part of the same event unless there is more than the input's gap between them.
+func mergeMotionEvents(input Input, recordings []Recording) []ApiV1MotionEvent {
+	samples := []motionSample{}
+	for _, recording := range recordings {
+		if recording.InputID != input.ID || !recording.PerformedMotionDetect {
+			continue
+		}
+		for _, m := range recording.Motion {
+			samples = append(samples, motionSample{
+				time:        recording.Start.Add(time.Duration(m.Time) * time.Second),
+				score:       m.Score,
+				zones:       m.Zones,
+				recordingID: recording.ID,
+			})
+		}
+	}
+	// recordings can overlap when a stream restarts
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].time.Before(samples[j].time)
+	})
+
+	gap := input.MotionEvents.Gap()
+	minDuration := input.MotionEvents.MinimumDuration()
+
+	motionEvents := []ApiV1MotionEvent{}
+	var current *ApiV1MotionEvent
+	finish := func() {
+		if current != nil && current.End.Sub(current.Start) >= minDuration {
+			motionEvents = append(motionEvents, *current)
+		}
+		current = nil
+	}
+	for _, sample := range samples {
+		if current != nil && sample.time.Sub(current.End) > gap {
+			finish()
+		}
+		if current == nil {
+			current = &ApiV1MotionEvent{
+				StreamID:  input.ID,
+				Start:     sample.time,
+				PeakTime:  sample.time,
+				PeakScore: sample.score,
+			}
+		}
+		if end := sample.time.Add(time.Second); end.After(current.End) {
+			current.End = end
+		}
+		if sample.score > current.PeakScore {
+			current.PeakTime, current.PeakScore = sample.time, sample.score
+		}
+		for name, score := range sample.zones {
+			if current.PeakZones == nil {
+				current.PeakZones = map[string]int{}
+			}
+			current.PeakZones[name] = max(current.PeakZones[name], score)
+		}
+		if !slices.Contains(current.RecordingIDs, sample.recordingID) {
+			current.RecordingIDs = append(current.RecordingIDs, sample.recordingID)
+		}
+	}
+	finish()
+	return motionEvents
+}
+
+// motionEventsQuery filters GET /api/motion-events
+type motionEventsQuery struct {
+	// StreamIDs only includes events of these streams, if not empty
+	StreamIDs []string
+	// From and To only include events overlapping this time range, if not zero
+	From time.Time
+	To   time.Time
+}
+
+func parseMotionEventsQuery(values url.Values) (motionEventsQuery, error) {
+	var (
+		q   motionEventsQuery
+		err error
+	)
+	for _, streamIDs := range values["stream_id"] {
+		q.StreamIDs = append(q.StreamIDs, strings.Split(streamIDs, ",")...)
+	}
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("invalid from, expected an RFC3339 time: %v", err)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, fmt.Errorf("invalid to, expected an RFC3339 time: %v", err)
+		}
+	}
+	return q, nil
+}
+
+// IncludesStream returns true if the query includes the stream's events
+func (q motionEventsQuery) IncludesStream(streamID string) bool {
+	return len(q.StreamIDs) == 0 || slices.Contains(q.StreamIDs, streamID)
+}
+
+// MayContribute returns true if the recording can contain motion of an event within the query's time range,
+// which is the time range widened by the gap between samples of the same event
+func (q motionEventsQuery) MayContribute(recording Recording, gap time.Duration) bool {
+	end := recording.End
+	if end.Before(recording.Start) {
+		end = recording.Start
+	}
+	if !q.From.IsZero() && end.Before(q.From.Add(-gap)) {
+		return false
+	}
+	if !q.To.IsZero() && recording.Start.After(q.To.Add(gap)) {
+		return false
+	}
+	return true
+}
+
+// Matches returns true if the event is within the query's time range
+func (q motionEventsQuery) Matches(event ApiV1MotionEvent) bool {
+	if !q.From.IsZero() && event.End.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && event.Start.After(q.To) {
+		return false
+	}
+	return true
+}
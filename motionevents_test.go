@@ -0,0 +1,130 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMergeMotionEvents(t *testing.T) {
+	start := testNow
+	first := Recording{ID: "cam-1.mp4", InputID: "cam", Start: start, End: start.Add(time.Minute), PerformedMotionDetect: true}
+	second := Recording{ID: "cam-2.mp4", InputID: "cam", Start: start.Add(time.Minute), End: start.Add(2 * time.Minute), PerformedMotionDetect: true}
+
+	type event struct {
+		start, end   time.Duration
+		peak         time.Duration
+		score        int
+		recordingIDs []string
+	}
+	tests := []struct {
+		name     string
+		input    Input
+		first    []motion
+		second   []motion
+		expected []event
+	}{
+		{
+			name:     "no motion",
+			input:    Input{ID: "cam"},
+			expected: []event{},
+		},
+		{
+			name:     "consecutive seconds",
+			input:    Input{ID: "cam"},
+			first:    []motion{{Time: 10, Score: 20}, {Time: 11, Score: 40}, {Time: 12, Score: 30}},
+			expected: []event{{10 * time.Second, 13 * time.Second, 11 * time.Second, 40, []string{"cam-1.mp4"}}},
+		},
+		{
+			name:     "split by gap",
+			input:    Input{ID: "cam"},
+			first:    []motion{{Time: 10, Score: 20}, {Time: 30, Score: 30}},
+			expected: []event{{10 * time.Second, 11 * time.Second, 10 * time.Second, 20, []string{"cam-1.mp4"}}, {30 * time.Second, 31 * time.Second, 30 * time.Second, 30, []string{"cam-1.mp4"}}},
+		},
+		{
+			name:     "within configured gap",
+			input:    Input{ID: "cam", MotionEvents: MotionEventsConfig{GapSeconds: 30}},
+			first:    []motion{{Time: 10, Score: 20}, {Time: 30, Score: 30}},
+			expected: []event{{10 * time.Second, 31 * time.Second, 30 * time.Second, 30, []string{"cam-1.mp4"}}},
+		},
+		{
+			name:     "across recordings",
+			input:    Input{ID: "cam"},
+			first:    []motion{{Time: 58, Score: 20}, {Time: 59, Score: 20}},
+			second:   []motion{{Time: 0, Score: 50}, {Time: 3, Score: 10}},
+			expected: []event{{58 * time.Second, 64 * time.Second, 60 * time.Second, 50, []string{"cam-1.mp4", "cam-2.mp4"}}},
+		},
+		{
+			name:     "minimum duration",
+			input:    Input{ID: "cam", MotionEvents: MotionEventsConfig{MinimumDurationSeconds: 2}},
+			first:    []motion{{Time: 10, Score: 20}, {Time: 30, Score: 30}, {Time: 31, Score: 30}},
+			expected: []event{{30 * time.Second, 32 * time.Second, 30 * time.Second, 30, []string{"cam-1.mp4"}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first, second := first, second
+			first.Motion, second.Motion = test.first, test.second
+			other := Recording{ID: "other-1.mp4", InputID: "other", Start: start, PerformedMotionDetect: true, Motion: []motion{{Time: 5, Score: 90}}}
+			undetected := Recording{ID: "cam-0.mp4", InputID: "cam", Start: start, Motion: []motion{{Time: 5, Score: 90}}}
+
+			events := mergeMotionEvents(test.input, []Recording{second, other, undetected, first})
+			if len(events) != len(test.expected) {
+				t.Fatalf("got %v events, expected %v: %+v", len(events), len(test.expected), events)
+			}
+			for i, expected := range test.expected {
+				got := events[i]
+				if !got.Start.Equal(start.Add(expected.start)) || !got.End.Equal(start.Add(expected.end)) || !got.PeakTime.Equal(start.Add(expected.peak)) || got.PeakScore != expected.score || !slices.Equal(got.RecordingIDs, expected.recordingIDs) {
+					t.Errorf("event %v: got %+v, expected %+v", i, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeMotionEventsZones(t *testing.T) {
+	recording := Recording{ID: "cam-1.mp4", InputID: "cam", Start: testNow, PerformedMotionDetect: true, Motion: []motion{
+		{Time: 0, Score: 20, Zones: map[string]int{"driveway": 20}},
+		{Time: 1, Score: 40, Zones: map[string]int{"driveway": 10, "porch": 40}},
+	}}
+	events := mergeMotionEvents(Input{ID: "cam"}, []Recording{recording})
+	if len(events) != 1 {
+		t.Fatalf("got %v events, expected 1", len(events))
+	}
+	if zones := events[0].PeakZones; zones["driveway"] != 20 || zones["porch"] != 40 {
+		t.Errorf("got peak zones %v", zones)
+	}
+}
+
+func TestMotionEventsQuery(t *testing.T) {
+	q := motionEventsQuery{From: testNow, To: testNow.Add(time.Hour)}
+	gap := 10 * time.Second
+
+	recordings := []struct {
+		name          string
+		start, end    time.Time
+		mayContribute bool
+	}{
+		{"before, beyond the gap", testNow.Add(-time.Hour), testNow.Add(-time.Minute), false},
+		{"before, within the gap", testNow.Add(-time.Hour), testNow.Add(-5 * time.Second), true},
+		{"inside", testNow.Add(time.Minute), testNow.Add(2 * time.Minute), true},
+		{"after, within the gap", testNow.Add(time.Hour + 5*time.Second), testNow.Add(2 * time.Hour), true},
+		{"after, beyond the gap", testNow.Add(time.Hour + time.Minute), testNow.Add(2 * time.Hour), false},
+		{"not probed yet", testNow.Add(time.Minute), time.Time{}, true},
+	}
+	for _, recording := range recordings {
+		if mayContribute := q.MayContribute(Recording{Start: recording.start, End: recording.end}, gap); mayContribute != recording.mayContribute {
+			t.Errorf("%v: got %v, expected %v", recording.name, mayContribute, recording.mayContribute)
+		}
+	}
+
+	if q.Matches(ApiV1MotionEvent{Start: testNow.Add(-time.Minute), End: testNow.Add(-time.Second)}) {
+		t.Errorf("matched event before the range")
+	}
+	if !q.Matches(ApiV1MotionEvent{Start: testNow.Add(-time.Minute), End: testNow.Add(time.Second)}) {
+		t.Errorf("didn't match event overlapping the range")
+	}
+	if !(motionEventsQuery{}).IncludesStream("cam") || (motionEventsQuery{StreamIDs: []string{"other"}}).IncludesStream("cam") {
+		t.Errorf("unexpected stream filtering")
+	}
+}
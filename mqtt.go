@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type MQTTConfig struct {
+	// Broker is the address of the MQTT broker, like "tcp://mqtt.local:1883" or "ssl://mqtt.local:8883"
+	Broker string `json:"broker"`
+	// ClientID defaults to "creamy-nvr-" followed by the hostname
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TopicPrefix is prepended to every topic we publish and subscribe to.
+	// Defaults to "creamy-nvr".
+	TopicPrefix string `json:"topic_prefix"`
+	// DiscoveryPrefix is the Home Assistant MQTT discovery prefix.
+	// Defaults to "homeassistant".
+	DiscoveryPrefix string `json:"discovery_prefix"`
+	// DisableDiscovery stops Home Assistant discovery payloads from being published
+	DisableDiscovery bool `json:"disable_discovery"`
+	// MotionOffSeconds is how long the motion binary_sensor stays on after motion is published.
+	// Defaults to 60.
+	MotionOffSeconds int `json:"motion_off_seconds"`
+}
+
+// Enabled returns true if a broker is configured
+func (c MQTTConfig) Enabled() bool {
+	return c.Broker != ""
+}
+
+// Prefix is TopicPrefix with the default applied
+func (c MQTTConfig) Prefix() string {
+	if c.TopicPrefix == "" {
+		return "creamy-nvr"
+	}
+	return strings.TrimSuffix(c.TopicPrefix, "/")
+}
+
+// Topic joins the topic prefix and the given levels
+func (c MQTTConfig) Topic(levels ...string) string {
+	return strings.Join(append([]string{c.Prefix()}, levels...), "/")
+}
+
+// StatusTopic is where "online" and "offline" are published when we connect and disconnect
+func (c MQTTConfig) StatusTopic() string {
+	return c.Topic("status")
+}
+
+// HomeAssistantPrefix is DiscoveryPrefix with the default applied
+func (c MQTTConfig) HomeAssistantPrefix() string {
+	if c.DiscoveryPrefix == "" {
+		return "homeassistant"
+	}
+	return strings.TrimSuffix(c.DiscoveryPrefix, "/")
+}
+
+// MotionOffDelay is MotionOffSeconds with the default applied
+func (c MQTTConfig) MotionOffDelay() time.Duration {
+	if c.MotionOffSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(c.MotionOffSeconds) * time.Second
+}
+
+// MQTTClient publishes to the configured broker, reconnecting whenever the connection is lost
+type MQTTClient struct {
+	config MQTTConfig
+	client mqtt.Client
+
+	lock          sync.Mutex
+	onConnect     []func()
+	subscriptions map[string]func(topic string, payload []byte)
+}
+
+// NewMQTTClient validates the config. Call Connect once every handler has been registered.
+func NewMQTTClient(config MQTTConfig) (*MQTTClient, error) {
+	if !strings.Contains(config.Broker, "://") {
+		return nil, errors.New("mqtt broker must include a scheme, like tcp://mqtt.local:1883")
+	}
+	clientID := config.ClientID
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = fmt.Sprintf("creamy-nvr-%v", hostname)
+	}
+
+	c := &MQTTClient{
+		config:        config,
+		subscriptions: map[string]func(string, []byte){},
+	}
+	logger := logger.WithField("unit", "mqtt").WithField("broker", config.Broker)
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(clientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetWill(config.StatusTopic(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(mqtt.Client) {
+			logger.Info("connected to mqtt broker")
+			c.handleConnect()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.WithError(err).Warn("lost connection to mqtt broker, reconnecting")
+		})
+	c.client = mqtt.NewClient(opts)
+	return c, nil
+}
+
+// Connect starts connecting to the broker in the background.
+// Messages published before the connection is up are queued by the client.
+func (c *MQTTClient) Connect() {
+	c.client.Connect()
+}
+
+// OnConnect registers a function that is called every time we connect to the broker
+func (c *MQTTClient) OnConnect(handler func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onConnect = append(c.onConnect, handler)
+}
+
+// Subscribe registers a handler for messages matching the topic filter.
+// Subscriptions are renewed every time we connect to the broker.
+func (c *MQTTClient) Subscribe(topic string, handler func(topic string, payload []byte)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.subscriptions[topic] = handler
+	if c.client.IsConnectionOpen() {
+		c.subscribe(topic, handler)
+	}
+}
+
+func (c *MQTTClient) subscribe(topic string, handler func(topic string, payload []byte)) {
+	token := c.client.Subscribe(topic, 1, func(_ mqtt.Client, message mqtt.Message) {
+		handler(message.Topic(), message.Payload())
+	})
+	go func() {
+		if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+			logger.WithField("unit", "mqtt").WithField("topic", topic).WithError(token.Error()).Warn("failed to subscribe")
+		}
+	}()
+}
+
+func (c *MQTTClient) handleConnect() {
+	c.Publish(c.config.StatusTopic(), true, []byte("online"))
+
+	c.lock.Lock()
+	for topic, handler := range c.subscriptions {
+		c.subscribe(topic, handler)
+	}
+	onConnect := slices.Clone(c.onConnect)
+	c.lock.Unlock()
+
+	for _, handler := range onConnect {
+		handler()
+	}
+}
+
+// Publish sends the payload to the topic without waiting for the broker to acknowledge it
+func (c *MQTTClient) Publish(topic string, retained bool, payload []byte) {
+	token := c.client.Publish(topic, 1, retained, payload)
+	go func() {
+		if token.WaitTimeout(30*time.Second) && token.Error() != nil {
+			logger.WithField("unit", "mqtt").WithField("topic", topic).WithError(token.Error()).Warn("failed to publish")
+		}
+	}()
+}
+
+// Close marks us as offline and disconnects from the broker, giving queued messages a second to be sent
+func (c *MQTTClient) Close() {
+	if c.client.IsConnectionOpen() {
+		c.client.Publish(c.config.StatusTopic(), 1, true, []byte("offline")).WaitTimeout(time.Second)
+	}
+	c.client.Disconnect(1000)
+}
+
+// MQTTBridge publishes the state of each stream and handles commands sent to it.
+//
+// For each stream, it publishes to {prefix}/{id}/...
+//   - state: the stream as returned by /api/streams (retained)
+//   - availability: "online" while the stream-capturing command is running, "offline" otherwise (retained)
+//   - problem: "ON" while any health check is failing, "OFF" otherwise (retained)
+//   - recording: "ON" while recording, "OFF" while paused (retained)
+//   - last_recording: the end time of the most recent recording (retained)
+//   - thumbnail: the JPEG thumbnail of the most recent recording (retained)
+//   - motion: "ON" when motion is detected in a recording that just ended,
+//     or "ON" and "OFF" as motion starts and stops with live motion detection
+//   - motion_event: the recording with motion, or the live motion event, as JSON
+//
+// And handles commands sent to {prefix}/{id}/...
+//   - restart: restarts the stream-capturing command
+//   - recording/set: "OFF" pauses recording, "ON" resumes it
+type MQTTBridge struct {
+	client    *MQTTClient
+	streams   []Stream
+	streamIdx map[string]int
+
+	subscription <-chan ApiV1Event
+	unsubscribe  func()
+
+	lock sync.Mutex
+	// latest are the most recent recordings with a thumbnail, by stream ID
+	latest map[string]ApiV1Recording
+}
+
+// NewMQTTBridge subscribes to events and registers command handlers with the client.
+// It must be called before the client connects.
+func NewMQTTBridge(client *MQTTClient, streams []Stream, streamIdx map[string]int) *MQTTBridge {
+	b := &MQTTBridge{
+		client:    client,
+		streams:   streams,
+		streamIdx: streamIdx,
+		latest:    map[string]ApiV1Recording{},
+	}
+	b.subscription, b.unsubscribe = events.Subscribe(256)
+
+	client.OnConnect(func() {
+		if !client.config.DisableDiscovery {
+			for i := range streams {
+				publishHomeAssistantDiscovery(client, &streams[i])
+			}
+		}
+		for i := range streams {
+			b.publishStream(&streams[i])
+		}
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for _, recording := range b.latest {
+			b.publishLatestRecording(recording)
+		}
+	})
+	client.Subscribe(client.config.Topic("+", "restart"), b.handleRestart)
+	client.Subscribe(client.config.Topic("+", "recording", "set"), b.handleSetRecording)
+	return b
+}
+
+// commandStream returns the stream a command topic like {prefix}/{id}/restart is for
+func (b *MQTTBridge) commandStream(topic string) *Stream {
+	id, _, _ := strings.Cut(strings.TrimPrefix(topic, b.client.config.Prefix()+"/"), "/")
+	streamIdx, ok := b.streamIdx[id]
+	if !ok {
+		logger.WithField("unit", "mqtt").WithField("topic", topic).Warn("received command for unknown stream")
+		return nil
+	}
+	return &b.streams[streamIdx]
+}
+
+func (b *MQTTBridge) handleRestart(topic string, _ []byte) {
+	stream := b.commandStream(topic)
+	if stream == nil {
+		return
+	}
+	logger := logger.WithField("unit", "mqtt").WithField("stream", stream.Input.ID)
+	restart := stream.RestartRecording.Load()
+	if !stream.Active.Load() || restart == nil {
+		logger.Warn("restart requested over mqtt, but stream is not running")
+		return
+	}
+	logger.Info("restarting stream on request")
+	restart()
+}
+
+func (b *MQTTBridge) handleSetRecording(topic string, payload []byte) {
+	stream := b.commandStream(topic)
+	if stream == nil {
+		return
+	}
+	logger := logger.WithField("unit", "mqtt").WithField("stream", stream.Input.ID)
+	switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+	case "ON":
+		logger.Info("resuming stream on request")
+		stream.SetPaused(false)
+	case "OFF":
+		logger.Info("pausing stream on request")
+		stream.SetPaused(true)
+	default:
+		logger.WithField("payload", string(payload)).Warn("expected ON or OFF")
+	}
+	// the state is published when the stream actually pauses or resumes, but let the sender know we heard it
+	b.publishStream(stream)
+}
+
+func onOff(on bool) []byte {
+	if on {
+		return []byte("ON")
+	}
+	return []byte("OFF")
+}
+
+// publishStream publishes the current state of the stream
+func (b *MQTTBridge) publishStream(stream *Stream) {
+	apiStream := newApiV1Stream(stream)
+	state, err := json.Marshal(&apiStream)
+	if err != nil {
+		logger.WithField("unit", "mqtt").WithError(err).Warn("failed to encode stream")
+		return
+	}
+	availability := "offline"
+	if apiStream.Active {
+		availability = "online"
+	}
+	b.client.Publish(b.client.config.Topic(stream.Input.ID, "state"), true, state)
+	b.client.Publish(b.client.config.Topic(stream.Input.ID, "availability"), true, []byte(availability))
+	b.client.Publish(b.client.config.Topic(stream.Input.ID, "problem"), true, onOff(apiStream.InErr))
+	b.client.Publish(b.client.config.Topic(stream.Input.ID, "recording"), true, onOff(!apiStream.Paused))
+}
+
+// publishLatestRecording publishes the end time and thumbnail of the most recent recording
+func (b *MQTTBridge) publishLatestRecording(recording ApiV1Recording) {
+	b.client.Publish(b.client.config.Topic(recording.StreamID, "last_recording"), true, []byte(recording.End))
+	thumbnail, err := os.ReadFile(strings.TrimPrefix(recording.ThumbnailPath, "/"))
+	if err != nil {
+		logger.WithField("unit", "mqtt").WithField("stream", recording.StreamID).WithError(err).Warn("failed to read thumbnail")
+		return
+	}
+	b.client.Publish(b.client.config.Topic(recording.StreamID, "thumbnail"), true, thumbnail)
+}
+
+func (b *MQTTBridge) handleEvent(event ApiV1Event) {
+	streamIdx, ok := b.streamIdx[event.StreamID]
+	if !ok {
+		return
+	}
+	stream := &b.streams[streamIdx]
+
+	switch {
+	case strings.HasPrefix(event.Type, "stream."):
+		// the event may be stale by the time we get to it, so publish the stream as it is now
+		b.publishStream(stream)
+	case event.Type == EventRecordingThumbnail:
+		// recordings are loaded oldest first on boot, but only publish the most recent one
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if latest, ok := b.latest[event.StreamID]; ok && latest.Start > event.Recording.Start {
+			return
+		}
+		b.latest[event.StreamID] = *event.Recording
+		b.publishLatestRecording(*event.Recording)
+	case event.Type == EventMotionStart || event.Type == EventMotionStop:
+		motionEvent, err := json.Marshal(event.LiveMotion)
+		if err != nil {
+			return
+		}
+		b.client.Publish(b.client.config.Topic(event.StreamID, "motion_event"), false, motionEvent)
+		b.client.Publish(b.client.config.Topic(event.StreamID, "motion"), false, onOff(event.Type == EventMotionStart))
+	case event.Type == EventRecordingMotion && stream.LiveMotion == nil:
+		end, err := time.Parse(time.RFC3339, event.Recording.End)
+		if err != nil || len(event.Recording.Motion) == 0 {
+			return
+		}
+		// motion is only detected once a recording ends, don't report old recordings processed on boot
+		if time.Since(end) > 3*time.Duration(stream.Input.SegmentTime())*time.Second {
+			return
+		}
+		motionEvent, err := json.Marshal(event.Recording)
+		if err != nil {
+			return
+		}
+		b.client.Publish(b.client.config.Topic(event.StreamID, "motion_event"), false, motionEvent)
+		b.client.Publish(b.client.config.Topic(event.StreamID, "motion"), false, onOff(true))
+	}
+}
+
+// Run publishes stream and recording updates until ctx is cancelled
+func (b *MQTTBridge) Run(ctx context.Context) {
+	defer func() { b.unsubscribe() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-b.subscription:
+			if !ok {
+				logger.WithField("unit", "mqtt").Error("fell behind on events, some updates were not published")
+				b.subscription, b.unsubscribe = events.Subscribe(256)
+				continue
+			}
+			b.handleEvent(event)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pixelDiffAlgorithmVersion should be bumped whenever pixelDiffTimeline output changes for the same input
+const pixelDiffAlgorithmVersion = 1
+
+// PixelDiffConfig tunes motion detection by comparing scaled-down grayscale frames,
+// used by live motion detection and the pixeldiff motion detector
+type PixelDiffConfig struct {
+	// Width and Height are the size frames are scaled to before comparing them.
+	// Defaults to 160x90.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// FPS is how many frames are compared each second.
+	// Defaults to 5.
+	FPS int `json:"fps,omitempty"`
+	// PixelThreshold is how much the brightness of a pixel (0-255) must change between frames to count as changed.
+	// Defaults to 25.
+	PixelThreshold int `json:"pixel_threshold,omitempty"`
+	// MinimumScore is the percentage of changed pixels that counts as motion.
+	// Seconds scoring less than this aren't saved with the recording.
+	// Defaults to 2.
+	MinimumScore int `json:"minimum_score,omitempty"`
+}
+
+// FrameSize is Width and Height with the defaults applied
+func (c PixelDiffConfig) FrameSize() (int, int) {
+	if c.Width <= 0 || c.Height <= 0 {
+		return 160, 90
+	}
+	return c.Width, c.Height
+}
+
+// FrameRate is FPS with the default applied
+func (c PixelDiffConfig) FrameRate() int {
+	if c.FPS <= 0 {
+		return 5
+	}
+	return c.FPS
+}
+
+// Threshold is PixelThreshold with the default applied
+func (c PixelDiffConfig) Threshold() int {
+	if c.PixelThreshold <= 0 {
+		return 25
+	}
+	return c.PixelThreshold
+}
+
+// MinScore is MinimumScore with the default applied
+func (c PixelDiffConfig) MinScore() int {
+	if c.MinimumScore <= 0 {
+		return 2
+	}
+	return c.MinimumScore
+}
+
+// filter is the ffmpeg filter graph producing the frames that are compared
+func (c PixelDiffConfig) filter() string {
+	width, height := c.FrameSize()
+	return "fps=" + strconv.Itoa(c.FrameRate()) + ",scale=" + strconv.Itoa(width) + ":" + strconv.Itoa(height) + ",format=gray"
+}
+
+// pixelDiffParams are the settings affecting pixel difference scores, see motionDetectorParams
+func pixelDiffParams(config PixelDiffConfig, zones []MotionZone) string {
+	return motionDetectorParams(struct {
+		PixelDiffConfig
+		Zones []MotionZone `json:"zones,omitempty"`
+	}{config, zones})
+}
+
+// zonePixels are the indexes of the pixels inside an include zone, not counting excluded pixels
+type zonePixels struct {
+	name   string
+	pixels []int
+}
+
+// pixelDiffScorer compares consecutive grayscale frames, only counting pixels within the input's motion zones
+type pixelDiffScorer struct {
+	threshold int
+	// counted are the indexes of the pixels counted towards the overall score
+	counted []int
+	zones   []zonePixels
+	changed []bool
+}
+
+// newPixelDiffScorer maps the zones onto the scaled frame.
+// Without include zones, the whole frame is counted, except for exclude zones.
+func newPixelDiffScorer(config PixelDiffConfig, zones []MotionZone) (*pixelDiffScorer, error) {
+	width, height := config.FrameSize()
+	s := &pixelDiffScorer{
+		threshold: config.Threshold(),
+		changed:   make([]bool, width*height),
+	}
+
+	var includes, excludes []MotionZone
+	for _, zone := range zones {
+		if zone.Exclude {
+			excludes = append(excludes, zone)
+		} else {
+			includes = append(includes, zone)
+			s.zones = append(s.zones, zonePixels{name: zone.Name})
+		}
+	}
+
+pixels:
+	for y := range height {
+		for x := range width {
+			// use the center of each pixel
+			nx, ny := (float64(x)+0.5)/float64(width), (float64(y)+0.5)/float64(height)
+			for _, zone := range excludes {
+				if zone.contains(nx, ny) {
+					continue pixels
+				}
+			}
+			counted := len(includes) == 0
+			for z, zone := range includes {
+				if zone.contains(nx, ny) {
+					counted = true
+					s.zones[z].pixels = append(s.zones[z].pixels, y*width+x)
+				}
+			}
+			if counted {
+				s.counted = append(s.counted, y*width+x)
+			}
+		}
+	}
+
+	if len(s.counted) == 0 {
+		return nil, fmt.Errorf("motion zones don't cover any pixels of the %vx%v frame", width, height)
+	}
+	return s, nil
+}
+
+// score returns the percentage of counted pixels whose brightness changed by more than the threshold,
+// and the same percentage within each include zone
+func (s *pixelDiffScorer) score(previous, current []byte) (int, map[string]int) {
+	changed := 0
+	for _, i := range s.counted {
+		diff := int(current[i]) - int(previous[i])
+		s.changed[i] = diff > s.threshold || -diff > s.threshold
+		if s.changed[i] {
+			changed++
+		}
+	}
+
+	var zoneScores map[string]int
+	for _, zone := range s.zones {
+		if len(zone.pixels) == 0 {
+			continue
+		}
+		zoneChanged := 0
+		for _, i := range zone.pixels {
+			if s.changed[i] {
+				zoneChanged++
+			}
+		}
+		if zoneChanged > 0 {
+			if zoneScores == nil {
+				zoneScores = map[string]int{}
+			}
+			zoneScores[zone.name] = zoneChanged * 100 / len(zone.pixels)
+		}
+	}
+	return changed * 100 / len(s.counted), zoneScores
+}
+
+// peakScore is the highest score of a second, overall and per zone
+type peakScore struct {
+	Score int
+	Zones map[string]int
+}
+
+func (p *peakScore) add(score int, zones map[string]int) {
+	p.Score = max(p.Score, score)
+	for name, zoneScore := range zones {
+		if p.Zones == nil {
+			p.Zones = map[string]int{}
+		}
+		p.Zones[name] = max(p.Zones[name], zoneScore)
+	}
+}
+
+// pixelDiffTimeline decodes the recording and scores it like live motion detection does,
+// so motion outside of the motion zones is ignored
+func pixelDiffTimeline(ctx context.Context, fpath string, config PixelDiffConfig, zones []MotionZone) ([]motion, error) {
+	scorer, err := newPixelDiffScorer(config, zones)
+	if err != nil {
+		return nil, err
+	}
+	width, height := config.FrameSize()
+	fps := config.FrameRate()
+	minScore := config.MinScore()
+
+	cmd := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-loglevel", "error",
+		"-i", fpath,
+		"-an",
+		"-vf", config.filter(),
+		"-f", "rawvideo",
+		"-pix_fmt", "gray",
+		"pipe:1",
+	)
+	cmd.Stderr = logger.WithField("unit", "motion").WithField("path", fpath).WriterLevel(logrus.WarnLevel)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pixeldiff ffmpeg %v: %v", fpath, err)
+	}
+
+	ms := []motion{}
+	flush := func(second int, peak peakScore) {
+		if peak.Score >= minScore {
+			ms = append(ms, motion{Time: second, Score: min(peak.Score, 100), Zones: peak.Zones})
+		}
+	}
+
+	reader := bufio.NewReaderSize(stdout, width*height)
+	previous, current := make([]byte, width*height), make([]byte, width*height)
+	_, readErr := io.ReadFull(reader, previous)
+	second, peak := 0, peakScore{}
+	for frame := 1; readErr == nil; frame++ {
+		if _, readErr = io.ReadFull(reader, current); readErr != nil {
+			break
+		}
+		if frame/fps != second {
+			flush(second, peak)
+			second, peak = frame/fps, peakScore{}
+		}
+		peak.add(scorer.score(previous, current))
+		previous, current = current, previous
+	}
+	flush(second, peak)
+
+	if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		// stop ffmpeg instead of leaving it blocked writing to the pipe we stopped reading
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to read pixeldiff frames of %v: %v", fpath, readErr)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to pixeldiff ffmpeg %v: %v", fpath, err)
+	}
+	return ms, nil
+}
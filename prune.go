@@ -0,0 +1,568 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pruneKindRecording     = "recording"
+	pruneKindStreamSegment = "stream_segment"
+	pruneKindClip          = "clip"
+
+	pruneReasonAge    = "age"
+	pruneReasonSize   = "size"
+	pruneReasonBudget = "budget"
+	// pruneReasonDiskSpace is used when free space dropped below Config.DiskSpace's low-water mark
+	pruneReasonDiskSpace = "disk_space"
+)
+
+type StorageBudgetConfig struct {
+	// Bytes is the most space recordings of all inputs can take up together.
+	// If 0, disabled.
+	Bytes int64 `json:"bytes"`
+	// Percent is the most space recordings of all inputs can take up together, as a percentage of the filesystem media/ is on.
+	// If 0, disabled.
+	// If both Bytes and Percent are set, the smaller limit is used.
+	Percent float64 `json:"percent"`
+}
+
+// Enabled returns true if a budget is configured
+func (c StorageBudgetConfig) Enabled() bool {
+	return c.Bytes > 0 || c.Percent > 0
+}
+
+// Limit returns the budget in bytes, measuring the filesystem of path if Percent is set
+func (c StorageBudgetConfig) Limit(path string) (int64, error) {
+	limit := c.Bytes
+	if c.Percent > 0 {
+		total, _, err := filesystemSpace(path)
+		if err != nil {
+			return 0, err
+		}
+		percentLimit := int64(float64(total) * c.Percent / 100)
+		if limit <= 0 || percentLimit < limit {
+			limit = percentLimit
+		}
+	}
+	return limit, nil
+}
+
+// StoragePriorityWeight is StoragePriority with the default applied
+func (i Input) StoragePriorityWeight() float64 {
+	if i.StoragePriority <= 0 {
+		return 1
+	}
+	return float64(i.StoragePriority)
+}
+
+// StorageMinimumRetention is StorageMinimumRetentionHours as a duration
+func (i Input) StorageMinimumRetention() time.Duration {
+	return time.Duration(max(i.StorageMinimumRetentionHours, 0)) * time.Hour
+}
+
+// filesystemSpace returns the total and available bytes of the filesystem path is on
+func filesystemSpace(path string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, fmt.Errorf("failed to statfs %v: %v", path, err)
+	}
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// pruneItem is a recording, including its thumbnail and sidecars, a stream segment or a clip
+type pruneItem struct {
+	InputID string
+	Kind    string
+	// Path is the recording's or clip's .mp4, or the stream segment's .ts
+	Path string
+	// Paths are every file of the item
+	Paths []string
+	Time  time.Time
+	Size  int64
+	// Lock protects the recording from pruning, if set
+	Lock *RecordingLock
+	// AwaitingMotion protects the recording from pruning until motion detection has been performed on it,
+	// see Input.MotionDetectionGracePeriod
+	AwaitingMotion bool
+	// ClipFailures is how many attempts at cutting clips from the recording failed, see maxClipAttempts
+	ClipFailures int
+}
+
+// protected returns true if the item must not be deleted to stay within size limits, the storage budget or free disk space
+func (item pruneItem) protected() bool {
+	return item.Lock != nil || item.AwaitingMotion
+}
+
+// pruneDeletion is an item the prune plan deletes, and why
+type pruneDeletion struct {
+	pruneItem
+	Reason string
+	// Clips are cut from the recording before it is deleted, see MotionRetentionConfig.Clips
+	Clips []motionClip
+}
+
+// prunePlan is everything a prune would delete, so it can be reviewed before being applied
+type prunePlan struct {
+	Deletions []pruneDeletion
+	// Sizes are the bytes each input's recordings, stream segments and clips took up while planning, by input and kind
+	Sizes map[string]map[string]int64
+}
+
+func (p *prunePlan) addSizes(inputID string, items []pruneItem) {
+	for _, item := range items {
+		if p.Sizes[inputID] == nil {
+			p.Sizes[inputID] = map[string]int64{}
+		}
+		p.Sizes[inputID][item.Kind] += item.Size
+	}
+}
+
+// Bytes is the total size of every deletion
+func (p prunePlan) Bytes() int64 {
+	var size int64
+	for _, deletion := range p.Deletions {
+		size += deletion.Size
+	}
+	return size
+}
+
+// listRecordings lists the recordings in the input's recording directory, oldest first
+func listRecordings(input Input) ([]pruneItem, error) {
+	return listRecordingFiles(input, input.RecordingDirectory(), pruneKindRecording)
+}
+
+// listClips lists the clips in the input's clip directory, oldest first
+func listClips(input Input) ([]pruneItem, error) {
+	return listRecordingFiles(input, input.ClipDirectory(), pruneKindClip)
+}
+
+// listRecordingFiles lists the recordings or clips in dir, oldest first
+func listRecordingFiles(input Input, dir string, kind string) ([]pruneItem, error) {
+	items := map[string]*pruneItem{}
+	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !isRecordingFile(path) || !strings.Contains(path, input.ID) || len(path) <= 24 {
+			return fmt.Errorf("unexpected file found in %v directory: %v", kind, path)
+		}
+		recordingDate, err := parseRecordingTime(path)
+		if err != nil {
+			return fmt.Errorf("failed to parse time from path %v: %v", path, err)
+		}
+
+		// thumbnails, alert snapshots and sidecars are deleted together with their recording
+		recordingPath := path[:strings.Index(path, ".mp4")+len(".mp4")]
+		item, ok := items[recordingPath]
+		if !ok {
+			item = &pruneItem{InputID: input.ID, Kind: kind, Path: recordingPath, Time: recordingDate}
+			items[recordingPath] = item
+		}
+		item.Paths = append(item.Paths, path)
+		item.Size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	recordings := make([]pruneItem, 0, len(items))
+	for _, item := range items {
+		recordings = append(recordings, *item)
+	}
+	sortPruneItems(recordings)
+	return recordings, nil
+}
+
+// listStreamSegments lists the segments in the input's stream segment directory, oldest first
+func listStreamSegments(input Input) ([]pruneItem, error) {
+	segments := []pruneItem{}
+	err := filepath.Walk(input.StreamSegmentDirectory(), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !strings.HasSuffix(path, ".ts") || !strings.Contains(path, input.ID) || len(path) <= 24 {
+			return fmt.Errorf("unexpected file found in stream segment directory: %v", path)
+		}
+
+		// abcd-000001-2025-05-01-22-21-52.ts
+		streamSegmentDateRaw := path[len(path)-22 : len(path)-3]
+		streamSegmentDate, err := time.Parse("2006-01-02-15-04-05", streamSegmentDateRaw)
+		if err != nil {
+			return fmt.Errorf("failed to parse time from path %v: %v", path, err)
+		}
+
+		segments = append(segments, pruneItem{
+			InputID: input.ID,
+			Kind:    pruneKindStreamSegment,
+			Path:    path,
+			Paths:   []string{path},
+			Time:    streamSegmentDate,
+			Size:    info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortPruneItems(segments)
+	return segments, nil
+}
+
+func sortPruneItems(items []pruneItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Time.Equal(items[j].Time) {
+			return items[i].Time.Before(items[j].Time)
+		}
+		return items[i].Path < items[j].Path
+	})
+}
+
+// planLimits plans deleting items older than maxAge, then the oldest items until they take up at most maxSize.
+// Limits of 0 are disabled. Locked items are never deleted, and protected items aren't deleted for their size,
+// but both still count towards maxSize.
+// The remaining items are returned.
+func planLimits(logger logrus.FieldLogger, plan *prunePlan, items []pruneItem, now time.Time, maxAge time.Duration, maxSize int64) []pruneItem {
+	if maxAge > 0 {
+		target := now.Add(-maxAge)
+		kept := items[:0:0]
+		for _, item := range items {
+			if item.Time.After(target) || item.Lock != nil {
+				kept = append(kept, item)
+			} else {
+				plan.Deletions = append(plan.Deletions, pruneDeletion{pruneItem: item, Reason: pruneReasonAge})
+			}
+		}
+		items = kept
+	}
+
+	if maxSize > 0 {
+		var size int64
+		for _, item := range items {
+			size += item.Size
+		}
+		kept := items[:0:0]
+		for i, item := range items {
+			if size <= maxSize {
+				kept = append(kept, items[i:]...)
+				break
+			}
+			if item.protected() {
+				kept = append(kept, item)
+				continue
+			}
+			plan.Deletions = append(plan.Deletions, pruneDeletion{pruneItem: item, Reason: pruneReasonSize})
+			size -= item.Size
+		}
+		items = kept
+		if size > maxSize {
+			logger.WithField("input", items[0].InputID).WithField("limit", maxSize).WithField("size", size).Warn("locked recordings or recordings awaiting motion detection exceed the size limit")
+		}
+	}
+	return items
+}
+
+// planOldest plans deleting the globally oldest recordings until at least bytes have been freed, and returns the remaining recordings.
+// Age is divided by each input's priority, so higher priority inputs keep recordings for longer,
+// and locked recordings, recordings awaiting motion detection or those within their input's minimum retention are never deleted.
+func planOldest(plan *prunePlan, config *Config, recordings []pruneItem, now time.Time, bytes int64, reason string) ([]pruneItem, int64) {
+	inputs := map[string]Input{}
+	for _, input := range config.Inputs {
+		inputs[input.ID] = input
+	}
+	candidates := []pruneItem{}
+	kept := []pruneItem{}
+	for _, recording := range recordings {
+		if !recording.protected() && now.Sub(recording.Time) > inputs[recording.InputID].StorageMinimumRetention() {
+			candidates = append(candidates, recording)
+		} else {
+			kept = append(kept, recording)
+		}
+	}
+	weightedAge := func(item pruneItem) float64 {
+		return float64(now.Sub(item.Time)) / inputs[item.InputID].StoragePriorityWeight()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return weightedAge(candidates[i]) > weightedAge(candidates[j])
+	})
+
+	var freed int64
+	for i, candidate := range candidates {
+		if freed >= bytes {
+			kept = append(kept, candidates[i:]...)
+			break
+		}
+		plan.Deletions = append(plan.Deletions, pruneDeletion{pruneItem: candidate, Reason: reason})
+		freed += candidate.Size
+	}
+	sortPruneItems(kept)
+	return kept, freed
+}
+
+// planBudget plans deleting the globally oldest recordings until all of them fit in the budget, see planOldest
+func planBudget(logger logrus.FieldLogger, plan *prunePlan, config *Config, recordings []pruneItem, now time.Time) []pruneItem {
+	limit, err := config.StorageBudget.Limit("media")
+	if err != nil {
+		logger.WithError(err).Error("failed to determine storage budget")
+		return recordings
+	}
+
+	var size int64
+	for _, recording := range recordings {
+		size += recording.Size
+	}
+	if size <= limit {
+		return recordings
+	}
+
+	recordings, freed := planOldest(plan, config, recordings, now, size-limit, pruneReasonBudget)
+	if size-freed > limit {
+		logger.WithField("limit", limit).WithField("size", size-freed).Warn("recordings exceed the storage budget, but the rest are locked, awaiting motion detection or within their stream's minimum retention")
+	}
+	return recordings
+}
+
+// planDiskSpace plans deleting the globally oldest recordings until the high-water mark is free
+// on the filesystem media/ is on, see planWatermarks
+func planDiskSpace(logger logrus.FieldLogger, plan *prunePlan, config *Config, recordings []pruneItem, now time.Time) {
+	total, free, err := filesystemSpace("media")
+	if err != nil {
+		logger.WithError(err).Error("failed to determine free disk space")
+		return
+	}
+	planWatermarks(logger, plan, config, recordings, now, total, free)
+}
+
+// planWatermarks plans deleting the globally oldest recordings until the high-water mark is free,
+// if free space (counting everything already planned) is below the low-water mark, see planOldest
+func planWatermarks(logger logrus.FieldLogger, plan *prunePlan, config *Config, recordings []pruneItem, now time.Time, total uint64, free uint64) {
+	low, high := config.DiskSpace.Watermarks(total)
+	available := int64(free) + plan.Bytes()
+	if available >= low {
+		return
+	}
+
+	_, freed := planOldest(plan, config, recordings, now, high-available, pruneReasonDiskSpace)
+	if available+freed < high {
+		logger.WithField("high_water", high).WithField("free", available+freed).Warn("free disk space stays below the high-water mark, but the rest of the recordings are locked, awaiting motion detection or within their stream's minimum retention")
+	}
+}
+
+// planPrune decides what to delete: recordings, stream segments and clips past each input's age and size limits,
+// then the oldest recordings of any input while they exceed the storage budget or free disk space is low.
+// Recordings protected by an unexpired lock are never deleted.
+func planPrune(logger logrus.FieldLogger, config *Config, locks []RecordingLock, clipFailures map[string]int, now time.Time) prunePlan {
+	plan := prunePlan{Sizes: map[string]map[string]int64{}}
+	remainingRecordings := []pruneItem{}
+
+	for _, input := range config.Inputs {
+		recordings, err := listRecordings(input)
+		if err != nil {
+			logger.WithError(err).WithField("input", input.ID).Error("failed to list recordings, not pruning them")
+		} else {
+			plan.addSizes(input.ID, recordings)
+			segmentTime := time.Duration(input.SegmentTime()) * time.Second
+			for i := range recordings {
+				recordings[i].Lock = findLock(locks, input.ID, filepath.Base(recordings[i].Path), recordings[i].Time, recordings[i].Time.Add(segmentTime), now)
+				recordings[i].AwaitingMotion = input.awaitingMotion(recordings[i], now)
+				recordings[i].ClipFailures = clipFailures[recordings[i].Path]
+			}
+			recordings = planRetention(logger, &plan, input, recordings, now)
+			recordings = planLimits(logger, &plan, recordings, now, 0, int64(input.RecordingSizeLimitMegabytes)*1000*1000)
+			remainingRecordings = append(remainingRecordings, recordings...)
+		}
+
+		clips, err := listClips(input)
+		if err != nil {
+			logger.WithError(err).WithField("input", input.ID).Error("failed to list clips, not pruning them")
+		} else {
+			plan.addSizes(input.ID, clips)
+			planLimits(logger, &plan, clips, now, time.Duration(input.MotionRetention.ClipAgeLimitHours)*time.Hour, 0)
+		}
+
+		segments, err := listStreamSegments(input)
+		if err != nil {
+			logger.WithError(err).WithField("input", input.ID).Error("failed to list stream segments, not pruning them")
+		} else {
+			plan.addSizes(input.ID, segments)
+			planLimits(logger, &plan, segments, now, time.Duration(input.StreamAgeLimitHours)*time.Hour, int64(input.StreamSizeLimitMegabytes)*1000*1000)
+		}
+	}
+
+	if config.StorageBudget.Enabled() {
+		remainingRecordings = planBudget(logger, &plan, config, remainingRecordings, now)
+	}
+	if config.DiskSpace.Enabled() {
+		planDiskSpace(logger, &plan, config, remainingRecordings, now)
+	}
+	return plan
+}
+
+// applyPrune deletes everything in the plan, calling removed after each recording is deleted.
+// Recordings are kept if their clips can't be cut, calling clipFailed so they're retried at most maxClipAttempts times.
+// The returned plan only contains the deletions that succeeded.
+func applyPrune(logger logrus.FieldLogger, plan prunePlan, removed func(recordingPath string), clipFailed func(recordingPath string)) prunePlan {
+	applied := prunePlan{Sizes: plan.Sizes}
+deletions:
+	for _, deletion := range plan.Deletions {
+		for _, clip := range deletion.Clips {
+			if err := extractClip(context.Background(), deletion.Path, clip); err != nil {
+				logger.WithError(err).WithField("path", deletion.Path).WithField("clip", clip.Path).WithField("input", deletion.InputID).Error("failed to cut clip, not pruning recording")
+				clipFailed(deletion.Path)
+				continue deletions
+			}
+			logger.WithField("path", deletion.Path).WithField("clip", clip.Path).WithField("input", deletion.InputID).Debug("cut clip")
+		}
+
+		deleted := true
+		for _, path := range deletion.Paths {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logger.WithError(err).WithField("path", path).WithField("input", deletion.InputID).Error("failed pruning file")
+				deleted = deleted && path != deletion.Path
+				continue
+			}
+			logger.WithField("path", path).WithField("input", deletion.InputID).WithField("reason", deletion.Reason).Debug("pruned file")
+			metrics.PruneDeletions.Add(1, "stream", deletion.InputID, "kind", deletion.Kind, "reason", deletion.Reason)
+		}
+		if !deleted {
+			continue
+		}
+		applied.Deletions = append(applied.Deletions, deletion)
+		if deletion.Kind == pruneKindRecording {
+			removed(deletion.Path)
+		}
+	}
+	return applied
+}
+
+// runPrune plans a prune and, unless dryRun, applies it after removing expired locks.
+// index may be nil during a dry run, leaving out locks.
+func runPrune(logger logrus.FieldLogger, config *Config, index *RecordingIndex, now time.Time, dryRun bool, removed func(recordingPath string)) (ApiV1PruneResult, error) {
+	locks := []RecordingLock{}
+	clipFailures := map[string]int{}
+	if index != nil {
+		if !dryRun {
+			if expired, err := index.DeleteExpiredLocks(now); err != nil {
+				logger.WithError(err).Error("failed to remove expired locks")
+			} else if expired > 0 {
+				logger.WithField("removed", expired).Info("removed expired locks")
+			}
+		}
+		var err error
+		if locks, err = index.Locks(); err != nil {
+			return ApiV1PruneResult{}, fmt.Errorf("failed to load locks: %v", err)
+		}
+		if clipFailures, err = index.ClipFailures(); err != nil {
+			return ApiV1PruneResult{}, fmt.Errorf("failed to load clip failures: %v", err)
+		}
+	}
+
+	plan := planPrune(logger, config, locks, clipFailures, now)
+	if !dryRun {
+		plan = applyPrune(logger, plan, removed, func(recordingPath string) {
+			if index == nil {
+				return
+			}
+			if err := index.AddClipFailure(recordingPath); err != nil {
+				logger.WithError(err).WithField("path", recordingPath).Error("failed to count clip failure")
+			}
+		})
+	}
+	return newApiV1PruneResult(config, plan, dryRun), nil
+}
+
+// ApiV1PruneResult is what a prune deleted, or would delete during a dry run
+type ApiV1PruneResult struct {
+	DryRun bool `json:"dry_run"`
+	// DeletedBytes is the size of every deletion
+	DeletedBytes int64              `json:"deleted_bytes"`
+	Streams      []ApiV1PruneStream `json:"streams"`
+}
+
+type ApiV1PruneStream struct {
+	StreamID     string               `json:"stream_id"`
+	Deletions    []ApiV1PruneDeletion `json:"deletions"`
+	DeletedBytes int64                `json:"deleted_bytes"`
+	// RecordingBytes, StreamSegmentBytes and ClipBytes are the space the stream's recordings, stream segments and clips take up after pruning,
+	// not counting clips cut while pruning
+	RecordingBytes     int64 `json:"recording_bytes"`
+	StreamSegmentBytes int64 `json:"stream_segment_bytes"`
+	ClipBytes          int64 `json:"clip_bytes"`
+}
+
+type ApiV1PruneDeletion struct {
+	// Kind is recording, stream_segment or clip
+	Kind string    `json:"kind"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	// Size includes the thumbnail and sidecars of a recording
+	Size int64 `json:"size"`
+	// Reason is age, size, budget or disk_space
+	Reason string `json:"reason"`
+	// Clips are cut from the recording before it is deleted
+	Clips []string `json:"clips,omitempty"`
+}
+
+func newApiV1PruneResult(config *Config, plan prunePlan, dryRun bool) ApiV1PruneResult {
+	result := ApiV1PruneResult{DryRun: dryRun, Streams: make([]ApiV1PruneStream, len(config.Inputs))}
+	for i, input := range config.Inputs {
+		stream := &result.Streams[i]
+		stream.StreamID = input.ID
+		stream.Deletions = []ApiV1PruneDeletion{}
+		stream.RecordingBytes = plan.Sizes[input.ID][pruneKindRecording]
+		stream.StreamSegmentBytes = plan.Sizes[input.ID][pruneKindStreamSegment]
+		stream.ClipBytes = plan.Sizes[input.ID][pruneKindClip]
+	}
+
+	inputIdx := map[string]int{}
+	for i, input := range config.Inputs {
+		inputIdx[input.ID] = i
+	}
+	for _, deletion := range plan.Deletions {
+		stream := &result.Streams[inputIdx[deletion.InputID]]
+		apiDeletion := ApiV1PruneDeletion{
+			Kind:   deletion.Kind,
+			Path:   "/" + deletion.Path,
+			Time:   deletion.Time,
+			Size:   deletion.Size,
+			Reason: deletion.Reason,
+		}
+		for _, clip := range deletion.Clips {
+			apiDeletion.Clips = append(apiDeletion.Clips, "/"+clip.Path)
+		}
+		stream.Deletions = append(stream.Deletions, apiDeletion)
+		stream.DeletedBytes += deletion.Size
+		result.DeletedBytes += deletion.Size
+		switch deletion.Kind {
+		case pruneKindRecording:
+			stream.RecordingBytes -= deletion.Size
+		case pruneKindStreamSegment:
+			stream.StreamSegmentBytes -= deletion.Size
+		case pruneKindClip:
+			stream.ClipBytes -= deletion.Size
+		}
+	}
+	return result
+}
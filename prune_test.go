@@ -0,0 +1,202 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var testNow = time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func testLogger() logrus.FieldLogger {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	return l
+}
+
+// testRecording is a recording of input that is age old and size bytes large
+func testRecording(input string, age time.Duration, size int64) pruneItem {
+	t := testNow.Add(-age)
+	path := "media/" + input + "/archive/" + input + "-" + t.Format("2006-01-02-15-04-05") + ".mp4"
+	return pruneItem{InputID: input, Kind: pruneKindRecording, Path: path, Paths: []string{path}, Time: t, Size: size}
+}
+
+// deletedPaths returns the path and reason of each deletion, in order
+func deletedPaths(plan prunePlan) []string {
+	deleted := []string{}
+	for _, deletion := range plan.Deletions {
+		deleted = append(deleted, deletion.Path+" "+deletion.Reason)
+	}
+	return deleted
+}
+
+func TestPlanLimits(t *testing.T) {
+	a := testRecording("cam", 3*time.Hour, 100)
+	b := testRecording("cam", 2*time.Hour, 100)
+	c := testRecording("cam", time.Hour, 100)
+	locked := testRecording("cam", 3*time.Hour, 100)
+	locked.Lock = &RecordingLock{ID: "lock"}
+	awaiting := testRecording("cam", 3*time.Hour, 100)
+	awaiting.AwaitingMotion = true
+
+	tests := []struct {
+		name    string
+		items   []pruneItem
+		maxAge  time.Duration
+		maxSize int64
+		deleted []string
+		kept    int
+	}{
+		{"no limits", []pruneItem{a, b, c}, 0, 0, []string{}, 3},
+		{"age", []pruneItem{a, b, c}, 150 * time.Minute, 0, []string{a.Path + " age"}, 2},
+		{"size deletes oldest first", []pruneItem{a, b, c}, 0, 150, []string{a.Path + " size", b.Path + " size"}, 1},
+		{"age then size", []pruneItem{a, b, c}, 150 * time.Minute, 100, []string{a.Path + " age", b.Path + " size"}, 1},
+		{"locked kept for age", []pruneItem{locked, c}, time.Minute, 0, []string{c.Path + " age"}, 1},
+		{"protected kept for size but counted", []pruneItem{locked, awaiting, b, c}, 0, 250, []string{b.Path + " size", c.Path + " size"}, 2},
+		{"awaiting motion deleted for age by planLimits", []pruneItem{awaiting}, time.Minute, 0, []string{awaiting.Path + " age"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := prunePlan{}
+			kept := planLimits(testLogger(), &plan, test.items, testNow, test.maxAge, test.maxSize)
+			if deleted := deletedPaths(plan); !slices.Equal(deleted, test.deleted) {
+				t.Errorf("deleted %v, expected %v", deleted, test.deleted)
+			}
+			if len(kept) != test.kept {
+				t.Errorf("kept %v items, expected %v", len(kept), test.kept)
+			}
+		})
+	}
+}
+
+func TestPlanOldest(t *testing.T) {
+	config := &Config{Inputs: []Input{
+		{ID: "low"},
+		{ID: "high", StoragePriority: 4},
+		{ID: "min", StorageMinimumRetentionHours: 10},
+	}}
+	low5h := testRecording("low", 5*time.Hour, 100)
+	low2h := testRecording("low", 2*time.Hour, 100)
+	high12h := testRecording("high", 12*time.Hour, 100)
+	high40h := testRecording("high", 40*time.Hour, 100)
+	min9h := testRecording("min", 9*time.Hour, 100)
+	min11h := testRecording("min", 11*time.Hour, 100)
+	locked := testRecording("low", 50*time.Hour, 100)
+	locked.Lock = &RecordingLock{ID: "lock"}
+	awaiting := testRecording("low", 50*time.Hour, 100)
+	awaiting.AwaitingMotion = true
+
+	tests := []struct {
+		name       string
+		recordings []pruneItem
+		bytes      int64
+		deleted    []string
+		freed      int64
+	}{
+		{
+			name:       "nothing to free",
+			recordings: []pruneItem{low5h, low2h},
+			bytes:      0,
+			deleted:    []string{},
+		},
+		{
+			name:       "oldest first",
+			recordings: []pruneItem{low2h, low5h},
+			bytes:      100,
+			deleted:    []string{low5h.Path + " budget"},
+			freed:      100,
+		},
+		{
+			// 12h / 4 = 3h weighted, younger than low's 5h
+			name:       "priority weighs age",
+			recordings: []pruneItem{high12h, low5h, low2h},
+			bytes:      200,
+			deleted:    []string{low5h.Path + " budget", high12h.Path + " budget"},
+			freed:      200,
+		},
+		{
+			// 40h / 4 = 10h weighted, older than low's 5h
+			name:       "old enough high priority recordings go first",
+			recordings: []pruneItem{high40h, low5h},
+			bytes:      100,
+			deleted:    []string{high40h.Path + " budget"},
+			freed:      100,
+		},
+		{
+			name:       "minimum retention",
+			recordings: []pruneItem{min9h, min11h, low2h},
+			bytes:      300,
+			deleted:    []string{min11h.Path + " budget", low2h.Path + " budget"},
+			freed:      200,
+		},
+		{
+			name:       "protected recordings",
+			recordings: []pruneItem{locked, awaiting, low2h},
+			bytes:      300,
+			deleted:    []string{low2h.Path + " budget"},
+			freed:      100,
+		},
+		{
+			name:       "stops once enough is freed",
+			recordings: []pruneItem{low5h, low2h},
+			bytes:      50,
+			deleted:    []string{low5h.Path + " budget"},
+			freed:      100,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := prunePlan{}
+			kept, freed := planOldest(&plan, config, test.recordings, testNow, test.bytes, pruneReasonBudget)
+			if deleted := deletedPaths(plan); !slices.Equal(deleted, test.deleted) {
+				t.Errorf("deleted %v, expected %v", deleted, test.deleted)
+			}
+			if freed != test.freed {
+				t.Errorf("freed %v, expected %v", freed, test.freed)
+			}
+			if len(kept)+len(plan.Deletions) != len(test.recordings) {
+				t.Errorf("kept %v and deleted %v of %v recordings", len(kept), len(plan.Deletions), len(test.recordings))
+			}
+			for i := 1; i < len(kept); i++ {
+				if kept[i].Time.Before(kept[i-1].Time) {
+					t.Errorf("kept recordings aren't sorted oldest first")
+				}
+			}
+		})
+	}
+}
+
+func TestPlanBudget(t *testing.T) {
+	a := testRecording("cam", 3*time.Hour, 100)
+	b := testRecording("cam", 2*time.Hour, 100)
+	c := testRecording("other", time.Hour, 100)
+
+	tests := []struct {
+		name    string
+		budget  int64
+		deleted []string
+	}{
+		{"within budget", 300, []string{}},
+		{"over budget", 150, []string{a.Path + " budget", b.Path + " budget"}},
+		{"across inputs", 50, []string{a.Path + " budget", b.Path + " budget", c.Path + " budget"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &Config{
+				Inputs:        []Input{{ID: "cam"}, {ID: "other"}},
+				StorageBudget: StorageBudgetConfig{Bytes: test.budget},
+			}
+			plan := prunePlan{}
+			kept := planBudget(testLogger(), &plan, config, []pruneItem{a, b, c}, testNow)
+			if deleted := deletedPaths(plan); !slices.Equal(deleted, test.deleted) {
+				t.Errorf("deleted %v, expected %v", deleted, test.deleted)
+			}
+			if len(kept)+len(plan.Deletions) != 3 {
+				t.Errorf("kept %v and deleted %v of 3 recordings", len(kept), len(plan.Deletions))
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"time"
+)
+
+// pruneCommand implements `creamy-nvr prune [--dry-run]`: it prunes once using the same config as the server,
+// and prints what was deleted, or would be deleted, as JSON
+func pruneCommand(args []string) {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print what would be deleted without deleting anything")
+	flags.Parse(args)
+
+	config := loadConfig()
+	logger := logger.WithField("unit", "prune").WithField("dry-run", *dryRun)
+
+	var (
+		index *RecordingIndex
+		err   error
+	)
+	if *dryRun {
+		// without an index there are no locks to take into account
+		if _, err = os.Stat(IndexPath); err == nil {
+			if index, err = OpenRecordingIndexReadOnly(IndexPath); err != nil {
+				logger.WithError(err).Fatal("failed to open recording index to read locks, stop the server or use POST /api/prune?dry_run=true instead")
+			}
+		} else if !os.IsNotExist(err) {
+			logger.WithError(err).Fatal("failed to check recording index")
+		}
+	} else if index, err = OpenRecordingIndex(IndexPath); err != nil {
+		logger.WithError(err).Fatal("failed to open recording index, stop the server or use POST /api/prune instead")
+	}
+	if index != nil {
+		defer index.Close()
+	}
+
+	result, err := runPrune(logger, &config, index, time.Now(), *dryRun, func(recordingPath string) {
+		if err := index.Delete(recordingPath); err != nil {
+			logger.WithError(err).WithField("path", recordingPath).Warn("failed to remove pruned recording from index")
+		}
+	})
+	if err != nil {
+		logger.WithError(err).Fatal("failed to prune")
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(&result); err != nil {
+		logger.WithError(err).Fatal("failed to write result")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ApiV1RecordingDetail struct {
+	ApiV1Recording
+
+	Size                   int64  `json:"size"`
+	MotionAlgorithm        string `json:"motion_algorithm,omitempty"`
+	MotionAlgorithmVersion int    `json:"motion_algorithm_version,omitempty"`
+	MotionMinimumScore     int    `json:"motion_minimum_score,omitempty"`
+	MotionParams           string `json:"motion_params,omitempty"`
+}
+
+func newApiV1Recording(recording Recording, streamName string) ApiV1Recording {
+	apiRecording := ApiV1Recording{
+		ID:                    recording.ID,
+		StreamID:              recording.InputID,
+		StreamName:            streamName,
+		Start:                 recording.Start.Format(time.RFC3339),
+		End:                   recording.End.Format(time.RFC3339),
+		Path:                  "/" + strings.TrimPrefix(recording.Path, "/"),
+		ThumbnailPath:         "/" + strings.TrimPrefix(recording.Path+".jpg", "/"),
+		PerformedMotionDetect: recording.PerformedMotionDetect,
+		Motion:                make([]ApiV1Motion, len(recording.Motion)),
+	}
+	for i := range recording.Motion {
+		apiRecording.Motion[i].Time = recording.Motion[i].Time
+		apiRecording.Motion[i].Score = recording.Motion[i].Score
+		apiRecording.Motion[i].Zones = recording.Motion[i].Zones
+		apiRecording.MaxMotionScore = max(apiRecording.MaxMotionScore, recording.Motion[i].Score)
+	}
+	return apiRecording
+}
+
+func newApiV1RecordingDetail(recording Recording, streamName string) ApiV1RecordingDetail {
+	return ApiV1RecordingDetail{
+		ApiV1Recording:         newApiV1Recording(recording, streamName),
+		Size:                   recording.Size,
+		MotionAlgorithm:        recording.MotionAlgorithm,
+		MotionAlgorithmVersion: recording.MotionAlgorithmVersion,
+		MotionMinimumScore:     recording.MotionMinimumScore,
+		MotionParams:           recording.MotionParams,
+	}
+}
+
+// recordingsCursor points at the last recording of a page.
+// Recordings are listed newest first, so the next page starts at the recording before it.
+type recordingsCursor struct {
+	Start time.Time
+	Path  string
+}
+
+func (c recordingsCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Start.UnixNano(), 10) + "|" + c.Path))
+}
+
+func parseRecordingsCursor(s string) (recordingsCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return recordingsCursor{}, err
+	}
+	start, path, ok := strings.Cut(string(decoded), "|")
+	if !ok {
+		return recordingsCursor{}, fmt.Errorf("missing separator")
+	}
+	nanos, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return recordingsCursor{}, err
+	}
+	return recordingsCursor{Start: time.Unix(0, nanos), Path: path}, nil
+}
+
+// after returns true if the recording comes after the cursor when listed newest first
+func (c recordingsCursor) after(recording Recording) bool {
+	if recording.Start.Equal(c.Start) {
+		return recording.Path < c.Path
+	}
+	return recording.Start.Before(c.Start)
+}
+
+// recordingsQuery filters and paginates GET /api/recordings
+type recordingsQuery struct {
+	// StreamIDs only includes recordings from these inputs, if not empty
+	StreamIDs []string
+	// From and To only include recordings overlapping this time range, if not zero
+	From time.Time
+	To   time.Time
+	// HasMotion only includes recordings with (true) or without (false) motion, if not nil.
+	// Recordings that haven't had motion detection performed yet are never included.
+	HasMotion *bool
+	// MinScore only counts motion samples with at least this score towards HasMotion
+	MinScore int
+	// Cursor continues from a previous page, if not nil
+	Cursor *recordingsCursor
+	// Limit is the maximum number of recordings to return, if not 0
+	Limit int
+	// Fields only includes these fields of each recording, if not empty
+	Fields []string
+}
+
+// maxRecordingsLimit caps the limit query parameter
+const maxRecordingsLimit = 1000
+
+func parseRecordingsQuery(values url.Values) (recordingsQuery, error) {
+	var (
+		q   recordingsQuery
+		err error
+	)
+	for _, streamIDs := range values["stream_id"] {
+		q.StreamIDs = append(q.StreamIDs, strings.Split(streamIDs, ",")...)
+	}
+	if from := values.Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return q, fmt.Errorf("invalid from, expected an RFC3339 time: %v", err)
+		}
+	}
+	if to := values.Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return q, fmt.Errorf("invalid to, expected an RFC3339 time: %v", err)
+		}
+	}
+	if hasMotion := values.Get("has_motion"); hasMotion != "" {
+		parsed, err := strconv.ParseBool(hasMotion)
+		if err != nil {
+			return q, fmt.Errorf("invalid has_motion, expected true or false")
+		}
+		q.HasMotion = &parsed
+	}
+	if minScore := values.Get("min_score"); minScore != "" {
+		if q.MinScore, err = strconv.Atoi(minScore); err != nil {
+			return q, fmt.Errorf("invalid min_score, expected an integer")
+		}
+		if q.HasMotion == nil {
+			// asking for a minimum score implies asking for motion
+			hasMotion := true
+			q.HasMotion = &hasMotion
+		}
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		parsed, err := parseRecordingsCursor(cursor)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		q.Cursor = &parsed
+	}
+	if limit := values.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 {
+			return q, fmt.Errorf("invalid limit, expected a positive integer")
+		}
+		q.Limit = min(q.Limit, maxRecordingsLimit)
+	}
+	if fields := values.Get("fields"); fields != "" {
+		q.Fields = strings.Split(fields, ",")
+	}
+	return q, nil
+}
+
+// Matches returns true if the recording passes every filter of the query, not including the cursor
+func (q recordingsQuery) Matches(recording Recording) bool {
+	if len(q.StreamIDs) > 0 && !slices.Contains(q.StreamIDs, recording.InputID) {
+		return false
+	}
+	if !q.From.IsZero() && recording.End.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && recording.Start.After(q.To) {
+		return false
+	}
+	if q.HasMotion != nil {
+		if !recording.PerformedMotionDetect {
+			return false
+		}
+		hasMotion := slices.ContainsFunc(recording.Motion, func(m motion) bool { return m.Score >= q.MinScore })
+		if hasMotion != *q.HasMotion {
+			return false
+		}
+	}
+	return true
+}
+
+// selectFields encodes v as a JSON object containing only the given fields
+func selectFields(v any, fields []string) (map[string]json.RawMessage, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(encoded, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			selected[field] = value
+		}
+	}
+	return selected, nil
+}
+
+// writeRecordingsPage writes the given recordings, only including the query's fields.
+// If there may be more recordings, the cursor for the next page is sent in the X-Next-Cursor and Link headers.
+func writeRecordingsPage(w http.ResponseWriter, r *http.Request, q recordingsQuery, apiRecordings []ApiV1Recording, next *recordingsCursor) {
+	if next != nil {
+		values := r.URL.Query()
+		values.Set("cursor", next.String())
+		w.Header().Set("X-Next-Cursor", next.String())
+		w.Header().Set("Link", fmt.Sprintf(`<%v?%v>; rel="next"`, r.URL.Path, values.Encode()))
+	}
+
+	if len(q.Fields) == 0 {
+		writeJSON(w, apiRecordings)
+		return
+	}
+
+	selected := make([]map[string]json.RawMessage, len(apiRecordings))
+	for i := range apiRecordings {
+		var err error
+		if selected[i], err = selectFields(apiRecordings[i], q.Fields); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, "failed to encode recordings")
+			return
+		}
+	}
+	writeJSON(w, selected)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecordingsCursorRoundTrip(t *testing.T) {
+	cursors := []recordingsCursor{
+		{Start: testNow, Path: "media/cam/archive/cam-2025-05-01-12-00-00.mp4"},
+		{Start: testNow.Add(123 * time.Nanosecond), Path: "path|with|separators"},
+		{Start: time.Unix(0, 0), Path: ""},
+	}
+	for _, cursor := range cursors {
+		parsed, err := parseRecordingsCursor(cursor.String())
+		if err != nil {
+			t.Errorf("failed to parse cursor %+v: %v", cursor, err)
+			continue
+		}
+		if !parsed.Start.Equal(cursor.Start) || parsed.Path != cursor.Path {
+			t.Errorf("got %+v, expected %+v", parsed, cursor)
+		}
+	}
+}
+
+func TestParseRecordingsCursorInvalid(t *testing.T) {
+	for _, s := range []string{"not base64!", "bm8tc2VwYXJhdG9y", "YWJjfHBhdGg"} {
+		if _, err := parseRecordingsCursor(s); err == nil {
+			t.Errorf("parsed invalid cursor %q", s)
+		}
+	}
+}
+
+func TestRecordingsCursorPages(t *testing.T) {
+	// newest first, recordings of the same stream restart share a start time
+	recordings := []Recording{
+		{Path: "c", Start: testNow},
+		{Path: "b", Start: testNow.Add(-time.Minute)},
+		{Path: "a", Start: testNow.Add(-time.Minute)},
+		{Path: "z", Start: testNow.Add(-2 * time.Minute)},
+	}
+	seen := []string{}
+	var cursor *recordingsCursor
+	for page := 0; page < len(recordings); page++ {
+		for _, recording := range recordings {
+			if cursor != nil && !cursor.after(recording) {
+				continue
+			}
+			seen = append(seen, recording.Path)
+			cursor = &recordingsCursor{Start: recording.Start, Path: recording.Path}
+			break
+		}
+	}
+	if expected := []string{"c", "b", "a", "z"}; !slices.Equal(seen, expected) {
+		t.Errorf("paged through %v, expected %v", seen, expected)
+	}
+}
+
+func TestParseRecordingsQuery(t *testing.T) {
+	q, err := parseRecordingsQuery(url.Values{
+		"stream_id": {"a,b", "c"},
+		"from":      {"2025-05-01T00:00:00Z"},
+		"min_score": {"20"},
+		"limit":     {"5000"},
+		"fields":    {"id,start"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(q.StreamIDs, []string{"a", "b", "c"}) {
+		t.Errorf("got stream ids %v", q.StreamIDs)
+	}
+	if !q.From.Equal(time.Date(2025, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got from %v", q.From)
+	}
+	if q.HasMotion == nil || !*q.HasMotion || q.MinScore != 20 {
+		t.Errorf("min_score should imply has_motion, got %v %v", q.HasMotion, q.MinScore)
+	}
+	if q.Limit != maxRecordingsLimit {
+		t.Errorf("got limit %v, expected it capped to %v", q.Limit, maxRecordingsLimit)
+	}
+
+	for _, values := range []url.Values{
+		{"from": {"yesterday"}},
+		{"has_motion": {"maybe"}},
+		{"limit": {"0"}},
+		{"cursor": {"!"}},
+	} {
+		if _, err := parseRecordingsQuery(values); err == nil {
+			t.Errorf("parsed invalid query %v", values)
+		}
+	}
+}
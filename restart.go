@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Exit reasons describe why the stream-capturing command last stopped
+const (
+	ExitReasonAuthFailed        = "auth_failed"
+	ExitReasonConnectionRefused = "connection_refused"
+	ExitReasonUnreachable       = "unreachable"
+	ExitReasonNotFound          = "not_found"
+	ExitReasonCodecError        = "codec_error"
+	ExitReasonDiskFull          = "disk_full"
+	ExitReasonStartFailed       = "start_failed"
+	ExitReasonKilled            = "killed"
+	ExitReasonExited            = "exited"
+)
+
+// exitReasonPatterns are matched against ffmpeg error lines, first match wins
+var exitReasonPatterns = []struct {
+	reason     string
+	substrings []string
+}{
+	{ExitReasonAuthFailed, []string{"401 Unauthorized", "403 Forbidden"}},
+	{ExitReasonConnectionRefused, []string{"Connection refused"}},
+	{ExitReasonUnreachable, []string{"No route to host", "Network is unreachable", "Connection timed out", "Operation timed out", "Host is unreachable", "Name or service not known", "Temporary failure in name resolution"}},
+	{ExitReasonNotFound, []string{"404 Not Found"}},
+	{ExitReasonDiskFull, []string{"No space left on device"}},
+	{ExitReasonCodecError, []string{"Invalid data found when processing input", "Could not find codec parameters", "could not find tag for codec", "not currently supported in container", "Error while decoding", "Unknown encoder", "Decoder not found", "Encoder not found"}},
+}
+
+// classifyFFmpegLine returns the exit reason an ffmpeg log line indicates, or "" if it doesn't indicate one
+func classifyFFmpegLine(line string) string {
+	if !strings.Contains(line, "[error]") && !strings.Contains(line, "[fatal]") {
+		return ""
+	}
+	for _, pattern := range exitReasonPatterns {
+		for _, substring := range pattern.substrings {
+			if strings.Contains(line, substring) {
+				return pattern.reason
+			}
+		}
+	}
+	return ""
+}
+
+// restartPolicy decides how long to wait before restarting the stream-capturing command.
+// Each consecutive failure multiplies the delay until it reaches the maximum.
+type restartPolicy struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+
+	failures int
+}
+
+func (i Input) restartPolicy() restartPolicy {
+	policy := restartPolicy{
+		initial:    time.Duration(i.RestartBackoffInitialSeconds) * time.Second,
+		max:        time.Duration(i.RestartBackoffMaxSeconds) * time.Second,
+		multiplier: i.RestartBackoffMultiplier,
+		jitter:     i.RestartBackoffJitter,
+	}
+	if policy.initial <= 0 {
+		policy.initial = 5 * time.Second
+	}
+	if policy.max <= 0 {
+		policy.max = 5 * time.Minute
+	}
+	if policy.max < policy.initial {
+		policy.max = policy.initial
+	}
+	if policy.multiplier < 1 {
+		policy.multiplier = 2
+	}
+	if policy.jitter < 0 {
+		policy.jitter = 0
+	} else if policy.jitter == 0 {
+		policy.jitter = 0.2
+	} else if policy.jitter > 1 {
+		policy.jitter = 1
+	}
+	return policy
+}
+
+// next records a failure and returns how long to wait before restarting
+func (p *restartPolicy) next() time.Duration {
+	delay := math.Min(float64(p.initial)*math.Pow(p.multiplier, float64(p.failures)), float64(p.max))
+	p.failures++
+	delay *= 1 + p.jitter*(rand.Float64()*2-1)
+	return time.Duration(delay)
+}
+
+// reset is called after a healthy run so the next failure starts over at the initial delay
+func (p *restartPolicy) reset() {
+	p.failures = 0
+}
+
+// Failures returns the amount of consecutive failures since the last healthy run
+func (p *restartPolicy) Failures() int {
+	return p.failures
+}
+
+// SetPaused pauses or resumes recording.
+// Pausing interrupts the stream-capturing command so it finalizes the current segment,
+// and it isn't restarted until recording is resumed.
+func (s *Stream) SetPaused(paused bool) {
+	if s.Paused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		if stop := s.StopRecording.Load(); stop != nil && s.Active.Load() {
+			stop()
+		}
+	}
+	select {
+	case s.pauseChanged <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassifyFFmpegLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		reason string
+	}{
+		{"[in#0 @ 0x1] [error] method DESCRIBE failed: 401 Unauthorized", ExitReasonAuthFailed},
+		{"[tcp @ 0x1] [error] Connection to tcp://10.0.0.2:554 failed: Connection refused", ExitReasonConnectionRefused},
+		{"[tcp @ 0x1] [error] Connection to tcp://10.0.0.2:554 failed: No route to host", ExitReasonUnreachable},
+		{"[rtsp @ 0x1] [error] method DESCRIBE failed: 404 Not Found", ExitReasonNotFound},
+		{"[segment @ 0x1] [fatal] Error writing trailer: No space left on device", ExitReasonDiskFull},
+		{"[in#0 @ 0x1] [error] Error opening input: Invalid data found when processing input", ExitReasonCodecError},
+		// warnings don't explain why ffmpeg stopped
+		{"[rtsp @ 0x1] [warning] 401 Unauthorized", ""},
+		{"[error] something nobody has seen before", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if reason := classifyFFmpegLine(test.line); reason != test.reason {
+			t.Errorf("%q: got %q, expected %q", test.line, reason, test.reason)
+		}
+	}
+}
+
+func TestRestartPolicyDefaults(t *testing.T) {
+	policy := Input{}.restartPolicy()
+	if policy.initial != 5*time.Second || policy.max != 5*time.Minute || policy.multiplier != 2 || policy.jitter != 0.2 {
+		t.Errorf("unexpected defaults %+v", policy)
+	}
+
+	policy = Input{RestartBackoffInitialSeconds: 60, RestartBackoffMaxSeconds: 10, RestartBackoffMultiplier: 0.5, RestartBackoffJitter: 3}.restartPolicy()
+	if policy.max != policy.initial || policy.multiplier != 2 || policy.jitter != 1 {
+		t.Errorf("invalid settings weren't corrected: %+v", policy)
+	}
+
+	if policy := (Input{RestartBackoffJitter: -1}).restartPolicy(); policy.jitter != 0 {
+		t.Errorf("negative jitter should disable it, got %v", policy.jitter)
+	}
+}
+
+func TestRestartPolicyNext(t *testing.T) {
+	policy := restartPolicy{initial: time.Second, max: 10 * time.Second, multiplier: 2}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, delay := range expected {
+		if next := policy.next(); next != delay {
+			t.Errorf("failure %v: got %v, expected %v", i+1, next, delay)
+		}
+	}
+	if policy.Failures() != len(expected) {
+		t.Errorf("got %v failures, expected %v", policy.Failures(), len(expected))
+	}
+
+	policy.reset()
+	if next := policy.next(); next != time.Second {
+		t.Errorf("got %v after reset, expected the initial delay", next)
+	}
+}
+
+func TestRestartPolicyJitter(t *testing.T) {
+	policy := restartPolicy{initial: 10 * time.Second, max: 10 * time.Second, multiplier: 2, jitter: 0.2}
+	for range 100 {
+		if next := policy.next(); next < 8*time.Second || next > 12*time.Second {
+			t.Fatalf("got %v, expected within 20%% of 10s", next)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// MotionRetentionConfig keeps recordings with motion for longer than recordings without it
+type MotionRetentionConfig struct {
+	// MotionAgeLimitHours is the amount of hours of recordings with motion to keep.
+	// If 0, Input.RecordingAgeLimitHours applies.
+	MotionAgeLimitHours int `json:"motion_age_limit_hours"`
+	// NoMotionAgeLimitHours is the amount of hours of recordings without motion to keep.
+	// If 0, Input.RecordingAgeLimitHours applies.
+	NoMotionAgeLimitHours int `json:"no_motion_age_limit_hours"`
+	// MinimumScore is the motion score a recording must reach to count as having motion.
+	// If 0, any motion saved with the recording counts, see Input.MotionDetectionMinimumScore.
+	MinimumScore int `json:"minimum_score"`
+	// Clips saves a short clip around each motion event of a recording to ClipDirectory before the recording is pruned for its age
+	Clips bool `json:"clips"`
+	// ClipPaddingSeconds is how much of the recording before and after each motion event is kept in its clip.
+	// Defaults to 5.
+	ClipPaddingSeconds int `json:"clip_padding_seconds"`
+	// ClipAgeLimitHours is the amount of hours of clips to keep.
+	// If 0, clips are kept until deleted by hand.
+	ClipAgeLimitHours int `json:"clip_age_limit_hours"`
+	// MotionDetectionGracePeriodHours lets recordings motion detection hasn't been performed on be pruned like any other once they are this old,
+	// so recordings motion detection keeps failing on don't fill the disk.
+	// If 0, they are kept until motion detection has been performed on them.
+	MotionDetectionGracePeriodHours int `json:"motion_detection_grace_period_hours"`
+}
+
+// Enabled returns true if recordings with and without motion are kept for different amounts of time
+func (c MotionRetentionConfig) Enabled() bool {
+	return c.MotionAgeLimitHours > 0 || c.NoMotionAgeLimitHours > 0
+}
+
+// ClipPadding is ClipPaddingSeconds with the default applied
+func (c MotionRetentionConfig) ClipPadding() time.Duration {
+	if c.ClipPaddingSeconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(c.ClipPaddingSeconds) * time.Second
+}
+
+// ClipDirectory contains .mp4 clips cut from this stream's recordings around motion, see MotionRetentionConfig.Clips
+func (i Input) ClipDirectory() string {
+	return fmt.Sprintf("media/%v/clips", i.ID)
+}
+
+// RecordingAgeLimit returns how long to keep a recording depending on whether it has motion, or 0 to keep it
+func (i Input) RecordingAgeLimit(hasMotion bool) time.Duration {
+	hours := i.RecordingAgeLimitHours
+	if hasMotion && i.MotionRetention.MotionAgeLimitHours > 0 {
+		hours = i.MotionRetention.MotionAgeLimitHours
+	} else if !hasMotion && i.MotionRetention.NoMotionAgeLimitHours > 0 {
+		hours = i.MotionRetention.NoMotionAgeLimitHours
+	}
+	return time.Duration(max(hours, 0)) * time.Hour
+}
+
+// MotionDetectionGracePeriod is how long recordings are kept while waiting for motion detection, if motion retention or clips are enabled,
+// or 0 to keep them until motion detection has been performed on them, see MotionRetentionConfig.MotionDetectionGracePeriodHours
+func (i Input) MotionDetectionGracePeriod() time.Duration {
+	return time.Duration(max(i.MotionRetention.MotionDetectionGracePeriodHours, 0)) * time.Hour
+}
+
+// hasMotionSidecar returns true if motion detection has been performed on the recording
+func (r pruneItem) hasMotionSidecar() bool {
+	return slices.Contains(r.Paths, motionSidecarPath(r.Path))
+}
+
+// awaitingMotion returns true if the recording must be kept until motion detection has been performed on it
+func (i Input) awaitingMotion(recording pruneItem, now time.Time) bool {
+	if !i.MotionRetention.Enabled() && !i.MotionRetention.Clips {
+		return false
+	}
+	if recording.hasMotionSidecar() {
+		return false
+	}
+	grace := i.MotionDetectionGracePeriod()
+	return grace <= 0 || now.Sub(recording.Time) <= grace
+}
+
+// maxClipAttempts is how many prunes try cutting clips from a recording before giving up and pruning it without them,
+// so a recording clips can never be cut from, like a corrupt one, doesn't stay forever
+const maxClipAttempts = 3
+
+// motionClip is a part of a recording to save before the recording is deleted
+type motionClip struct {
+	// Offset and Duration locate the clip in the recording
+	Offset   time.Duration
+	Duration time.Duration
+	Path     string
+}
+
+// motionClips returns a clip for each motion event of the recording, padded on both sides
+func motionClips(input Input, recording pruneItem, m []motion) []motionClip {
+	events := mergeMotionEvents(input, []Recording{{
+		ID:                    recording.Path,
+		InputID:               input.ID,
+		Start:                 recording.Time,
+		PerformedMotionDetect: true,
+		Motion:                m,
+	}})
+
+	padding := input.MotionRetention.ClipPadding()
+	clips := []motionClip{}
+	for _, event := range events {
+		start := event.Start.Add(-padding)
+		if start.Before(recording.Time) {
+			start = recording.Time
+		}
+		clips = append(clips, motionClip{
+			Offset:   start.Sub(recording.Time),
+			Duration: event.End.Add(padding).Sub(start),
+			Path:     filepath.Join(input.ClipDirectory(), input.ID+"-"+start.Format("2006-01-02-15-04-05")+".mp4"),
+		})
+	}
+	return clips
+}
+
+// planRetention plans deleting recordings past their age limit, which depends on whether they have motion.
+// With motion retention or clips enabled, recordings aren't deleted for their age before motion detection has been performed on them,
+// unless their opt-in grace period runs out. The remaining recordings are returned.
+func planRetention(logger logrus.FieldLogger, plan *prunePlan, input Input, recordings []pruneItem, now time.Time) []pruneItem {
+	if !input.MotionRetention.Enabled() && !input.MotionRetention.Clips {
+		return planLimits(logger, plan, recordings, now, time.Duration(input.RecordingAgeLimitHours)*time.Hour, 0)
+	}
+
+	minimumAgeLimit := min(input.RecordingAgeLimit(true), input.RecordingAgeLimit(false))
+	if minimumAgeLimit <= 0 {
+		minimumAgeLimit = max(input.RecordingAgeLimit(true), input.RecordingAgeLimit(false))
+	}
+	if minimumAgeLimit <= 0 {
+		return recordings
+	}
+
+	kept := recordings[:0:0]
+	awaitingMotion := 0
+	for _, recording := range recordings {
+		if now.Sub(recording.Time) <= minimumAgeLimit || recording.Lock != nil {
+			kept = append(kept, recording)
+			continue
+		}
+
+		if recording.AwaitingMotion {
+			awaitingMotion++
+			kept = append(kept, recording)
+			continue
+		}
+		if !recording.hasMotionSidecar() {
+			logger.WithField("path", recording.Path).WithField("grace_period", input.MotionDetectionGracePeriod().String()).Warn("motion detection wasn't performed on recording within its grace period, pruning it for its age")
+			plan.Deletions = append(plan.Deletions, pruneDeletion{pruneItem: recording, Reason: pruneReasonAge})
+			continue
+		}
+
+		_, m, err := readMotionSidecar(recording.Path)
+		if err != nil {
+			logger.WithError(err).WithField("path", recording.Path).Warn("failed to read motion sidecar, not pruning recording for its age")
+			kept = append(kept, recording)
+			continue
+		}
+
+		hasMotion := false
+		for _, sample := range m {
+			if sample.Score >= input.MotionRetention.MinimumScore {
+				hasMotion = true
+				break
+			}
+		}
+		ageLimit := input.RecordingAgeLimit(hasMotion)
+		if ageLimit <= 0 || now.Sub(recording.Time) <= ageLimit {
+			kept = append(kept, recording)
+			continue
+		}
+
+		deletion := pruneDeletion{pruneItem: recording, Reason: pruneReasonAge}
+		if hasMotion && input.MotionRetention.Clips && recording.ClipFailures >= maxClipAttempts {
+			logger.WithField("path", recording.Path).WithField("attempts", recording.ClipFailures).Warn("giving up cutting clips from recording, pruning it without them")
+		} else if hasMotion && input.MotionRetention.Clips {
+			clipMotion := m[:0:0]
+			for _, sample := range m {
+				if sample.Score >= input.MotionRetention.MinimumScore {
+					clipMotion = append(clipMotion, sample)
+				}
+			}
+			deletion.Clips = motionClips(input, recording, clipMotion)
+		}
+		plan.Deletions = append(plan.Deletions, deletion)
+	}
+	if awaitingMotion > 0 {
+		logger.WithField("input", input.ID).WithField("recordings", awaitingMotion).Warn("recordings old enough to be pruned are kept until motion detection has been performed on them")
+	}
+	return kept
+}
+
+// extractClip copies part of the recording to clipPath, without re-encoding it
+func extractClip(ctx context.Context, recordingPath string, clip motionClip) error {
+	if err := os.MkdirAll(filepath.Dir(clip.Path), 0755); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(
+		ctx,
+		"ffmpeg",
+		"-y",
+		"-loglevel", "error",
+		"-ss", strconv.FormatFloat(clip.Offset.Seconds(), 'f', -1, 64),
+		"-i", recordingPath,
+		"-t", strconv.FormatFloat(clip.Duration.Seconds(), 'f', -1, 64),
+		"-c", "copy",
+		"-movflags", "+faststart",
+		clip.Path,
+	)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(clip.Path)
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		return fmt.Errorf("%v: %v", err, lines[len(lines)-1])
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testDetectedRecording is a recording in dir with a motion sidecar containing m, or without one if m is nil
+func testDetectedRecording(t *testing.T, dir string, input Input, age time.Duration, m []motion) pruneItem {
+	recording := testRecording(input.ID, age, 100)
+	recording.Path = filepath.Join(dir, filepath.Base(recording.Path))
+	recording.Paths = []string{recording.Path}
+	if m != nil {
+		if err := writeMotionSidecar(recording.Path, MotionDetectorInfo{Algorithm: "test"}, m); err != nil {
+			t.Fatal(err)
+		}
+		recording.Paths = append(recording.Paths, motionSidecarPath(recording.Path))
+	}
+	recording.AwaitingMotion = input.awaitingMotion(recording, testNow)
+	return recording
+}
+
+func TestRecordingAgeLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     Input
+		hasMotion bool
+		limit     time.Duration
+	}{
+		{"falls back to recording age limit", Input{RecordingAgeLimitHours: 5}, true, 5 * time.Hour},
+		{"motion", Input{RecordingAgeLimitHours: 5, MotionRetention: MotionRetentionConfig{MotionAgeLimitHours: 48}}, true, 48 * time.Hour},
+		{"no motion", Input{RecordingAgeLimitHours: 5, MotionRetention: MotionRetentionConfig{NoMotionAgeLimitHours: 2}}, false, 2 * time.Hour},
+		{"no motion falls back", Input{RecordingAgeLimitHours: 5, MotionRetention: MotionRetentionConfig{MotionAgeLimitHours: 48}}, false, 5 * time.Hour},
+		{"kept forever", Input{}, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if limit := test.input.RecordingAgeLimit(test.hasMotion); limit != test.limit {
+				t.Errorf("got %v, expected %v", limit, test.limit)
+			}
+		})
+	}
+}
+
+func TestAwaitingMotion(t *testing.T) {
+	retention := MotionRetentionConfig{MotionAgeLimitHours: 48, NoMotionAgeLimitHours: 2}
+	tests := []struct {
+		name     string
+		input    Input
+		age      time.Duration
+		detected bool
+		awaiting bool
+	}{
+		{"motion retention disabled", Input{ID: "cam", RecordingAgeLimitHours: 1}, 3 * time.Hour, false, false},
+		{"detected", Input{ID: "cam", MotionRetention: retention}, 3 * time.Hour, true, false},
+		{"not detected is kept without a grace period", Input{ID: "cam", MotionRetention: retention}, 1000 * time.Hour, false, true},
+		{"clips alone keep recordings", Input{ID: "cam", RecordingAgeLimitHours: 1, MotionRetention: MotionRetentionConfig{Clips: true}}, 3 * time.Hour, false, true},
+		{"within grace period", Input{ID: "cam", MotionRetention: MotionRetentionConfig{NoMotionAgeLimitHours: 2, MotionDetectionGracePeriodHours: 24}}, 3 * time.Hour, false, true},
+		{"past grace period", Input{ID: "cam", MotionRetention: MotionRetentionConfig{NoMotionAgeLimitHours: 2, MotionDetectionGracePeriodHours: 24}}, 25 * time.Hour, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recording := testRecording("cam", test.age, 100)
+			if test.detected {
+				recording.Paths = append(recording.Paths, motionSidecarPath(recording.Path))
+			}
+			if awaiting := test.input.awaitingMotion(recording, testNow); awaiting != test.awaiting {
+				t.Errorf("got %v, expected %v", awaiting, test.awaiting)
+			}
+		})
+	}
+}
+
+func TestPlanRetention(t *testing.T) {
+	motionful := []motion{{Time: 10, Score: 50}}
+	quiet := []motion{{Time: 10, Score: 10}}
+	none := []motion{}
+
+	type recordingSpec struct {
+		age          time.Duration
+		m            []motion
+		locked       bool
+		clipFailures int
+	}
+	tests := []struct {
+		name       string
+		retention  MotionRetentionConfig
+		recordings []recordingSpec
+		// deleted are the indexes of deleted recordings and whether clips are cut from them
+		deleted map[int]bool
+	}{
+		{
+			name:      "motion kept longer",
+			retention: MotionRetentionConfig{MotionAgeLimitHours: 48, NoMotionAgeLimitHours: 2, MinimumScore: 20},
+			recordings: []recordingSpec{
+				{age: time.Hour, m: none},
+				{age: 3 * time.Hour, m: none},
+				{age: 3 * time.Hour, m: quiet},
+				{age: 3 * time.Hour, m: motionful},
+				{age: 50 * time.Hour, m: motionful},
+			},
+			deleted: map[int]bool{1: false, 2: false, 4: false},
+		},
+		{
+			name:      "never deletes recordings awaiting motion detection",
+			retention: MotionRetentionConfig{MotionAgeLimitHours: 48, NoMotionAgeLimitHours: 2},
+			recordings: []recordingSpec{
+				{age: 3 * time.Hour},
+				{age: 1000 * time.Hour},
+			},
+			deleted: map[int]bool{},
+		},
+		{
+			name:      "opt-in grace period",
+			retention: MotionRetentionConfig{MotionAgeLimitHours: 48, NoMotionAgeLimitHours: 2, MotionDetectionGracePeriodHours: 24},
+			recordings: []recordingSpec{
+				{age: 3 * time.Hour},
+				{age: 25 * time.Hour},
+			},
+			deleted: map[int]bool{1: false},
+		},
+		{
+			name:      "locked",
+			retention: MotionRetentionConfig{NoMotionAgeLimitHours: 2},
+			recordings: []recordingSpec{
+				{age: 3 * time.Hour, m: none, locked: true},
+			},
+			deleted: map[int]bool{},
+		},
+		{
+			name:      "clips",
+			retention: MotionRetentionConfig{MotionAgeLimitHours: 48, NoMotionAgeLimitHours: 2, Clips: true},
+			recordings: []recordingSpec{
+				{age: 50 * time.Hour, m: motionful},
+				{age: 50 * time.Hour, m: none},
+				{age: 50 * time.Hour, m: motionful, clipFailures: maxClipAttempts - 1},
+				{age: 50 * time.Hour, m: motionful, clipFailures: maxClipAttempts},
+			},
+			deleted: map[int]bool{0: true, 1: false, 2: true, 3: false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := Input{ID: "cam", MotionRetention: test.retention}
+			recordings := []pruneItem{}
+			for _, spec := range test.recordings {
+				// recordings of the same age need their own directory
+				recording := testDetectedRecording(t, t.TempDir(), input, spec.age, spec.m)
+				if spec.locked {
+					recording.Lock = &RecordingLock{ID: "lock"}
+				}
+				recording.ClipFailures = spec.clipFailures
+				recordings = append(recordings, recording)
+			}
+
+			plan := prunePlan{}
+			kept := planRetention(testLogger(), &plan, input, recordings, testNow)
+			if len(plan.Deletions) != len(test.deleted) {
+				t.Fatalf("deleted %v, expected %v deletions", deletedPaths(plan), len(test.deleted))
+			}
+			for i, recording := range recordings {
+				j := slices.IndexFunc(plan.Deletions, func(deletion pruneDeletion) bool { return deletion.Path == recording.Path })
+				clips, shouldDelete := test.deleted[i]
+				if (j >= 0) != shouldDelete {
+					t.Errorf("recording %v deleted: %v, expected %v", i, j >= 0, shouldDelete)
+					continue
+				}
+				if j >= 0 && (len(plan.Deletions[j].Clips) > 0) != clips {
+					t.Errorf("recording %v has clips: %v, expected %v", i, plan.Deletions[j].Clips, clips)
+				}
+			}
+			if len(kept)+len(plan.Deletions) != len(recordings) {
+				t.Errorf("kept %v and deleted %v of %v recordings", len(kept), len(plan.Deletions), len(recordings))
+			}
+		})
+	}
+}
+
+func TestMotionClips(t *testing.T) {
+	input := Input{ID: "cam", MotionRetention: MotionRetentionConfig{Clips: true}}
+	recording := testRecording("cam", time.Hour, 100)
+	m := []motion{{Time: 2, Score: 50}, {Time: 30, Score: 50}, {Time: 31, Score: 50}, {Time: 32, Score: 50}}
+
+	clips := motionClips(input, recording, m)
+	expected := []motionClip{
+		// padding before the first event is cut short by the start of the recording
+		{Offset: 0, Duration: 8 * time.Second, Path: filepath.Join(input.ClipDirectory(), "cam-"+recording.Time.Format("2006-01-02-15-04-05")+".mp4")},
+		{Offset: 25 * time.Second, Duration: 13 * time.Second, Path: filepath.Join(input.ClipDirectory(), "cam-"+recording.Time.Add(25*time.Second).Format("2006-01-02-15-04-05")+".mp4")},
+	}
+	if !slices.Equal(clips, expected) {
+		t.Errorf("got %v, expected %v", clips, expected)
+	}
+}
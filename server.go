@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type ListenConfig struct {
+	// Addresses are the TCP addresses to serve the web UI and API on, like ":3000" or "127.0.0.1:3000".
+	// If empty, defaults to ":3000" unless UnixSocket is set.
+	Addresses []string `json:"addresses"`
+	// UnixSocket is the path of a Unix socket to serve plain HTTP on, for reverse proxies.
+	// A stale socket left at this path is removed on boot, any other file at this path fails startup.
+	UnixSocket string `json:"unix_socket"`
+	// UnixSocketMode is the octal file mode of UnixSocket.
+	// Defaults to "0660".
+	UnixSocketMode string `json:"unix_socket_mode"`
+	// TLSCertFile and TLSKeyFile are PEM files used to serve HTTPS on Addresses.
+	// They are reloaded when either file changes, so renewing a certificate doesn't require a restart.
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// HTTPRedirectAddresses are TCP addresses that redirect plain HTTP requests to HTTPS, like ":80".
+	// Requires TLSCertFile and TLSKeyFile.
+	HTTPRedirectAddresses []string `json:"http_redirect_addresses"`
+}
+
+// TLSEnabled returns true if Addresses serve HTTPS
+func (c ListenConfig) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// TCPAddresses is Addresses with the default applied
+func (c ListenConfig) TCPAddresses() []string {
+	if len(c.Addresses) == 0 && c.UnixSocket == "" {
+		return []string{":3000"}
+	}
+	return c.Addresses
+}
+
+// SocketMode is UnixSocketMode with the default applied
+func (c ListenConfig) SocketMode() (os.FileMode, error) {
+	if c.UnixSocketMode == "" {
+		return 0660, nil
+	}
+	mode, err := strconv.ParseUint(c.UnixSocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unix_socket_mode %q: %v", c.UnixSocketMode, err)
+	}
+	return os.FileMode(mode), nil
+}
+
+func (c ListenConfig) validate() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("both tls_cert_file and tls_key_file must be set to enable TLS")
+	}
+	if len(c.HTTPRedirectAddresses) > 0 && !c.TLSEnabled() {
+		return errors.New("http_redirect_addresses requires tls_cert_file and tls_key_file")
+	}
+	if len(c.HTTPRedirectAddresses) > 0 && len(c.TCPAddresses()) == 0 {
+		return errors.New("http_redirect_addresses requires an HTTPS address to redirect to")
+	}
+	_, err := c.SocketMode()
+	return err
+}
+
+// certReloader serves the most recently loaded certificate, reloading it when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	cert     AValue[*tls.Certificate]
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reloadIfChanged loads the certificate if either file has been modified since it was last loaded
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	var modTimes [2]time.Time
+	for i, fpath := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(fpath)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if modTimes == r.modTimes {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.cert.Store(&cert)
+	r.modTimes = modTimes
+	return true, nil
+}
+
+// watch checks for changed files until ctx is cancelled.
+// If a reload fails, for example because only one of the files has been replaced so far, the previous certificate is kept.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	logger := logger.WithField("unit", "tls").WithField("cert", r.certFile)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.reloadIfChanged()
+			if err != nil {
+				logger.WithError(err).Warn("failed to reload certificate, still using the previous one")
+			} else if reloaded {
+				logger.Info("reloaded certificate")
+			}
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// httpsRedirect redirects every request to the same path on httpsAddress
+func httpsRedirect(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// Servers are the HTTP servers listening on each configured address
+type Servers struct {
+	servers []*http.Server
+	wg      sync.WaitGroup
+}
+
+// removeStaleSocket removes the socket left at path by a previous run.
+// Anything else at path is left alone, so a typo in the config can't delete a regular file.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check stale unix socket: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix_socket %v already exists and isn't a socket, refusing to remove it", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale unix socket: %v", err)
+	}
+	return nil
+}
+
+// StartServers listens on every configured address and serves handler in the background.
+// Errors opening listeners are returned immediately, errors while serving are passed to onError.
+func StartServers(ctx context.Context, config ListenConfig, handler http.Handler, onError func(error)) (*Servers, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if config.TLSEnabled() {
+		reloader, err := newCertReloader(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		go reloader.watch(ctx, 10*time.Second)
+		tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+
+	s := &Servers{}
+	var listeners []net.Listener
+	closeListeners := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	type pending struct {
+		listener net.Listener
+		server   *http.Server
+	}
+	var servers []pending
+
+	for _, addr := range config.TCPAddresses() {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		server := &http.Server{Addr: addr, Handler: handler}
+		if tlsConfig != nil {
+			server.TLSConfig = tlsConfig
+			l = tls.NewListener(l, tlsConfig)
+		}
+		servers = append(servers, pending{l, server})
+	}
+
+	for _, addr := range config.HTTPRedirectAddresses {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		servers = append(servers, pending{l, &http.Server{Addr: addr, Handler: httpsRedirect(config.TCPAddresses()[0])}})
+	}
+
+	if config.UnixSocket != "" {
+		mode, _ := config.SocketMode()
+		if err := removeStaleSocket(config.UnixSocket); err != nil {
+			closeListeners()
+			return nil, err
+		}
+		l, err := net.Listen("unix", config.UnixSocket)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		if err := os.Chmod(config.UnixSocket, mode); err != nil {
+			closeListeners()
+			return nil, fmt.Errorf("failed to chmod unix socket: %v", err)
+		}
+		servers = append(servers, pending{l, &http.Server{Addr: config.UnixSocket, Handler: handler}})
+	}
+
+	for _, p := range servers {
+		logger.WithField("unit", "http").WithField("address", p.server.Addr).WithField("tls", p.server.TLSConfig != nil).Info("listening")
+		s.servers = append(s.servers, p.server)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := p.server.Serve(p.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				onError(err)
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Shutdown gracefully shuts down every server, closing them if ctx expires first
+func (s *Servers) Shutdown(ctx context.Context) {
+	for _, server := range s.servers {
+		go func() {
+			if err := server.Shutdown(ctx); err != nil {
+				logger.WithError(err).WithField("address", server.Addr).Warn("failed to gracefully shut down http server")
+				server.Close()
+			}
+		}()
+	}
+}
+
+// Wait blocks until every server has stopped
+func (s *Servers) Wait() {
+	s.wg.Wait()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// MotionSidecar is saved next to each recording as `<recording>.mp4.json` once motion detection has been performed on it
+type MotionSidecar struct {
+	MotionDetectorInfo
+	Motion []ApiV1Motion `json:"motion"`
+}
+
+// motionResultsCurrent returns true if motion detected this way doesn't need to be detected again for this input.
+// Results of live motion detection are kept while it stays enabled with the same settings, since the live stream can't be decoded again later.
+func (i Input) motionResultsCurrent(info MotionDetectorInfo) bool {
+	if i.LiveMotion.Enabled && info.Algorithm == liveMotionAlgorithm {
+		return info == i.liveMotionInfo()
+	}
+	return info == i.MotionDetector().Info()
+}
+
+// Matches returns true if this sidecar is up to date for the input
+func (s MotionSidecar) Matches(input Input) bool {
+	return input.motionResultsCurrent(s.MotionDetectorInfo)
+}
+
+func motionSidecarPath(recordingPath string) string {
+	return recordingPath + ".json"
+}
+
+func writeMotionSidecar(recordingPath string, info MotionDetectorInfo, m []motion) error {
+	sidecar := MotionSidecar{
+		MotionDetectorInfo: info,
+		Motion:             make([]ApiV1Motion, len(m)),
+	}
+	for i := range m {
+		sidecar.Motion[i].Time = m[i].Time
+		sidecar.Motion[i].Score = m[i].Score
+		sidecar.Motion[i].Zones = m[i].Zones
+	}
+	data, err := json.Marshal(&sidecar)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(motionSidecarPath(recordingPath), data, 0644)
+}
+
+func readMotionSidecar(recordingPath string) (MotionSidecar, []motion, error) {
+	var sidecar MotionSidecar
+	data, err := os.ReadFile(motionSidecarPath(recordingPath))
+	if err != nil {
+		return sidecar, nil, err
+	}
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return sidecar, nil, fmt.Errorf("failed to parse motion sidecar of %v: %v", recordingPath, err)
+	}
+	m := make([]motion, len(sidecar.Motion))
+	for i := range sidecar.Motion {
+		m[i].Time = sidecar.Motion[i].Time
+		m[i].Score = sidecar.Motion[i].Score
+		m[i].Zones = sidecar.Motion[i].Zones
+	}
+	return sidecar, m, nil
+}
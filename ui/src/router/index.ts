@@ -5,6 +5,8 @@ import CameraTimelineView from '@/views/CameraTimelineView.vue'
 import RecordingsView from '@/views/RecordingsView.vue';
 import RecordingView from '@/views/RecordingView.vue';
 import LiveView from '@/views/LiveView.vue';
+import LoginView from '@/views/LoginView.vue';
+import { useAuthStore } from '@/stores/auth';
 
 const router = createRouter({
   history: createWebHistory(import.meta.env.BASE_URL),
@@ -46,7 +48,24 @@ const router = createRouter({
       name: 'live-view',
       component: LiveView,
     },
+    {
+      path: '/login',
+      name: 'login',
+      component: LoginView,
+    },
   ],
 })
 
+router.beforeEach(async (to) => {
+  if (to.name === 'login') {
+    return true;
+  }
+  const authStore = useAuthStore();
+  const me = authStore.me || await authStore.loadMe();
+  if (me.auth_enabled && !me.authenticated) {
+    return { name: 'login', query: { redirect: to.fullPath } };
+  }
+  return true;
+});
+
 export default router
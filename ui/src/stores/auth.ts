@@ -0,0 +1,42 @@
+import { computed, ref } from 'vue'
+import { defineStore } from 'pinia'
+import * as types from './authTypes'
+
+export const useAuthStore = defineStore('auth', () => {
+  const me = ref(null as types.Me | null);
+
+  // viewers can only watch live streams
+  const canReview = computed(() => me.value?.role === 'reviewer' || me.value?.role === 'admin');
+
+  async function loadMe() {
+    const resp = await fetch('/api/me');
+    me.value = await resp.json();
+    return me.value as types.Me;
+  };
+
+  async function login(username: string, password: string) {
+    const resp = await fetch('/api/login', {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ username, password }),
+    });
+    const json = await resp.json();
+    if (!resp.ok) {
+      throw new Error(json.error || 'Failed to log in');
+    }
+    me.value = json;
+  };
+
+  async function logout() {
+    await fetch('/api/logout', { method: 'POST' });
+    me.value = null;
+  };
+
+  return {
+    me,
+    canReview,
+    loadMe,
+    login,
+    logout,
+  };
+})
@@ -0,0 +1,15 @@
+export type Role = 'viewer' | 'reviewer' | 'admin';
+
+export interface Me {
+  username?: string;
+  /**
+   * If false, users aren't configured and everything is public
+   */
+  auth_enabled: boolean;
+  authenticated: boolean;
+  role?: Role;
+  /**
+   * Input IDs this user can access, every camera if missing
+   */
+  cameras?: string[];
+}
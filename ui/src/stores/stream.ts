@@ -12,20 +12,93 @@ export const useStreamStore = defineStore('stream', () => {
 
   async function loadStreams() {
     const resp = await fetch('/api/streams');
+    if (!resp.ok) {
+      return;
+    }
     const json = await resp.json();
     streams.value = json;
   };
 
   async function loadRecordings() {
     const resp = await fetch('/api/recordings');
+    if (!resp.ok) {
+      return;
+    }
     const json = await resp.json();
     recordings.value = json;
   };
 
+  // Motion events of a stream overlapping the time range, newest first
+  async function loadMotionEvents(streamId: string, from: Date, to: Date) {
+    const params = new URLSearchParams({
+      stream_id: streamId,
+      from: from.toISOString(),
+      to: to.toISOString(),
+    });
+    const resp = await fetch(`/api/motion-events?${params}`);
+    if (!resp.ok) {
+      return [] as types.MotionEvent[];
+    }
+    return await resp.json() as types.MotionEvent[];
+  };
+
+  let eventSource = null as EventSource | null;
+
+  // Keep streams and recordings up to date as things happen, instead of polling
+  function subscribe() {
+    eventSource?.close();
+    eventSource = new EventSource('/api/events');
+
+    const onStreamEvent = (e: MessageEvent) => {
+      const event: types.Event = JSON.parse(e.data);
+      if (!event.stream) {
+        return;
+      }
+      const idx = streams.value.findIndex(s => s.id === event.stream_id);
+      if (idx !== -1) {
+        streams.value[idx] = event.stream;
+      }
+    };
+    for (const type of ['stream.active', 'stream.inactive', 'stream.restart', 'stream.check', 'stream.paused', 'stream.resumed']) {
+      eventSource.addEventListener(type, onStreamEvent);
+    }
+    const onLiveMotion = (e: MessageEvent) => {
+      const event: types.Event = JSON.parse(e.data);
+      const stream = streams.value.find(s => s.id === event.stream_id);
+      if (stream) {
+        stream.motion = event.type === 'motion.start';
+      }
+    };
+    eventSource.addEventListener('motion.start', onLiveMotion);
+    eventSource.addEventListener('motion.stop', onLiveMotion);
+
+    eventSource.addEventListener('recording.new', (e: MessageEvent) => {
+      const event: types.Event = JSON.parse(e.data);
+      if (event.recording && !recordings.value.some(r => r.id === event.recording!.id)) {
+        recordings.value.unshift(event.recording);
+      }
+    });
+    const onRecordingUpdated = (e: MessageEvent) => {
+      const event: types.Event = JSON.parse(e.data);
+      const idx = recordings.value.findIndex(r => r.id === event.recording?.id);
+      if (idx !== -1 && event.recording) {
+        recordings.value[idx] = event.recording;
+      }
+    };
+    eventSource.addEventListener('recording.motion', onRecordingUpdated);
+    eventSource.addEventListener('recording.thumbnail', onRecordingUpdated);
+    eventSource.addEventListener('recording.pruned', (e: MessageEvent) => {
+      const event: types.Event = JSON.parse(e.data);
+      recordings.value = recordings.value.filter(r => r.id !== event.recording?.id);
+    });
+  };
+
   return {
+    subscribe,
     streams,
     loadStreams,
     recordings,
     loadRecordings,
+    loadMotionEvents,
   };
 })
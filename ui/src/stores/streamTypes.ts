@@ -3,6 +3,19 @@ export interface Stream {
   name: string;
   active: boolean;
   in_err: boolean;
+  /**
+   * True while recording has been paused
+   */
+  paused: boolean;
+  /**
+   * True while live motion detection sees motion
+   */
+  motion: boolean;
+  /**
+   * Names of the stream's failing health checks
+   * @example ["inactive", "last_file_opened"]
+   */
+  failing_checks: string[];
   last_recording: string;
   source: string;
 }
@@ -20,6 +33,11 @@ export interface Motion {
    * @example 16 extreme score
    */
   s: number;
+  /**
+   * The score of each motion zone, 0-100, if the stream has motion zones
+   * @example { "driveway": 12, "porch": 0 }
+   */
+  z?: Record<string, number>;
 }
 
 export interface Recording {
@@ -36,4 +54,158 @@ export interface Recording {
    */
   performed_motion_detect: boolean;
   motion: Motion[];
+  /**
+   * The highest score in .motion, 0 if there is no motion
+   */
+  max_motion_score: number;
+  /**
+   * Protects the recording from pruning, if it is locked
+   */
+  lock?: RecordingLock;
+}
+
+export interface PruneDeletion {
+  /**
+   * @example "recording"
+   * @example "stream_segment"
+   * @example "clip"
+   */
+  kind: string;
+  path: string;
+  time: string;
+  size: number;
+  /**
+   * @example "age"
+   * @example "size"
+   * @example "budget"
+   * @example "disk_space"
+   */
+  reason: string;
+  /**
+   * Clips cut from the recording before it is deleted
+   */
+  clips?: string[];
+}
+
+export interface PruneStream {
+  stream_id: string;
+  deletions: PruneDeletion[];
+  deleted_bytes: number;
+  /**
+   * Sizes after pruning
+   */
+  recording_bytes: number;
+  stream_segment_bytes: number;
+  clip_bytes: number;
+}
+
+/**
+ * What POST /api/prune deleted, or would delete if dry_run is set
+ */
+export interface PruneResult {
+  dry_run: boolean;
+  deleted_bytes: number;
+  streams: PruneStream[];
+}
+
+export interface RecordingLock {
+  id: string;
+  stream_id: string;
+  /**
+   * Set if the lock protects a single recording
+   */
+  recording_id?: string;
+  /**
+   * Set if the lock protects every recording of the stream overlapping this time range
+   */
+  start?: string;
+  end?: string;
+  reason?: string;
+  /**
+   * Unset if the lock never expires
+   */
+  expires?: string;
+  created_by?: string;
+  created: string;
+}
+
+export interface EventCheck {
+  name: string;
+  failing: boolean;
+}
+
+export interface Event {
+  id: number;
+  /**
+   * @example "stream.active"
+   * @example "recording.new"
+   */
+  type: string;
+  time: string;
+  stream_id: string;
+  /**
+   * The state of the stream after the event, for stream.* events
+   */
+  stream?: Stream;
+  /**
+   * The watchdog check that changed, for stream.check events
+   */
+  check?: EventCheck;
+  /**
+   * The recording after the event, for recording.* events
+   */
+  recording?: Recording;
+  /**
+   * The motion that triggered a motion.alert event
+   */
+  alert?: MotionAlert;
+  /**
+   * The motion seen on the live stream, for motion.start and motion.stop events
+   */
+  live_motion?: LiveMotion;
+}
+
+export interface MotionAlert {
+  recording_id: string;
+  /**
+   * Seconds into the recording of the highest motion score
+   */
+  peak_offset: number;
+  peak_time: string;
+  peak_score: number;
+  snapshot_path?: string;
+  link: string;
+}
+
+export interface LiveMotion {
+  start: string;
+  /**
+   * When motion was last seen, only set for motion.stop events
+   */
+  end?: string;
+  peak_time: string;
+  peak_score: number;
+  /**
+   * The highest score of each motion zone during the event, if the stream has motion zones
+   */
+  peak_zones?: Record<string, number>;
+}
+
+/**
+ * Motion merged from the per-second motion of one or more recordings
+ */
+export interface MotionEvent {
+  stream_id: string;
+  start: string;
+  /**
+   * The end of the last second with motion
+   */
+  end: string;
+  peak_time: string;
+  peak_score: number;
+  peak_zones?: Record<string, number>;
+  /**
+   * Recordings the motion was seen in, oldest first
+   */
+  recording_ids: string[];
 }
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"os"
+	"slices"
+	"time"
+)
+
+// RestartErrThreshold is RestartErrThresholdSeconds with the default applied
+func (i Input) RestartErrThreshold() time.Duration {
+	if i.RestartErrThresholdSeconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(i.RestartErrThresholdSeconds) * time.Second
+}
+
+// FileOpenedErrThreshold is FileOpenedErrThresholdSeconds with the default applied:
+// three minutes, or three live stream chunks if those are longer
+func (i Input) FileOpenedErrThreshold() time.Duration {
+	if i.FileOpenedErrThresholdSeconds > 0 {
+		return time.Duration(i.FileOpenedErrThresholdSeconds) * time.Second
+	}
+	return max(3*time.Minute, 3*time.Duration(i.HLSTime())*time.Second)
+}
+
+// SegmentOpenedErrThreshold is SegmentOpenedErrThresholdSeconds with the default applied:
+// three recordings
+func (i Input) SegmentOpenedErrThreshold() time.Duration {
+	if i.SegmentOpenedErrThresholdSeconds > 0 {
+		return time.Duration(i.SegmentOpenedErrThresholdSeconds) * time.Second
+	}
+	return 3 * time.Duration(i.SegmentTime()) * time.Second
+}
+
+// StallThreshold is StallThresholdSeconds with the default applied:
+// one minute, or six live stream chunks if those are longer
+func (i Input) StallThreshold() time.Duration {
+	if i.StallThresholdSeconds > 0 {
+		return time.Duration(i.StallThresholdSeconds) * time.Second
+	}
+	return max(time.Minute, 6*time.Duration(i.HLSTime())*time.Second)
+}
+
+// InErr returns true if the stream isn't running or any of its health checks are failing
+func (s *Stream) InErr() bool {
+	return len(s.FailingChecks()) > 0
+}
+
+// FailingChecks returns the names of the stream's failing health checks, including "inactive" if it isn't running.
+// Paused streams have no failing checks.
+func (s *Stream) FailingChecks() []string {
+	checks := []string{}
+	if s.Paused.Load() {
+		return checks
+	}
+	if !s.Active.Load() {
+		checks = append(checks, "inactive")
+	}
+	if s.LastRestartInErr.Load() {
+		checks = append(checks, "last_restart")
+	}
+	if s.LastFileOpenedInErr.Load() {
+		checks = append(checks, "last_file_opened")
+	}
+	if s.LastSegmentOpenedInErr.Load() {
+		checks = append(checks, "last_segment_opened")
+	}
+	if s.PlaylistStalledInErr.Load() {
+		checks = append(checks, "playlist_stalled")
+	}
+	if s.SegmentStalledInErr.Load() {
+		checks = append(checks, "segment_stalled")
+	}
+	if s.DiskFull.Load() {
+		checks = append(checks, "disk_full")
+	}
+	return checks
+}
+
+// publishCheckEvents publishes a stream.check event for every watchdog check that started or stopped failing.
+// Activity is covered by stream.active and stream.inactive instead.
+func publishCheckEvents(stream *Stream, previouslyFailing []string) {
+	failing := stream.FailingChecks()
+	for _, check := range []string{"last_restart", "last_file_opened", "last_segment_opened", "playlist_stalled", "segment_stalled", "disk_full"} {
+		wasFailing, isFailing := slices.Contains(previouslyFailing, check), slices.Contains(failing, check)
+		if wasFailing == isFailing {
+			continue
+		}
+		apiStream := newApiV1Stream(stream)
+		events.Publish(ApiV1Event{
+			Type:     EventStreamCheck,
+			StreamID: stream.Input.ID,
+			Stream:   &apiStream,
+			Check:    &ApiV1EventCheck{Name: check, Failing: isFailing},
+		})
+	}
+}
+
+// watchdogInterval is how often the watchdog checks streams:
+// a third of the smallest threshold, between five seconds and one minute
+func watchdogInterval(streams []Stream) time.Duration {
+	interval := time.Minute
+	for i := range streams {
+		input := streams[i].Input
+		for _, threshold := range []time.Duration{input.RestartErrThreshold(), input.FileOpenedErrThreshold(), input.SegmentOpenedErrThreshold(), input.StallThreshold()} {
+			interval = min(interval, threshold/3)
+		}
+	}
+	return max(interval, 5*time.Second)
+}
+
+// segmentGrowth tracks the size of the segment a stream is currently writing
+type segmentGrowth struct {
+	name     string
+	size     int64
+	lastGrew time.Time
+}
+
+// watchdog periodically updates the *InErr flags of each stream, restarting streams that look frozen
+func watchdog(ctx context.Context, streams []Stream) {
+	growth := make([]segmentGrowth, len(streams))
+
+	restart := func(stream *Stream) {
+		if !stream.Active.Load() {
+			// already stopped, will be restarted after its backoff
+			return
+		}
+		restart := stream.RestartRecording.Load()
+		if restart != nil {
+			restart()
+		} else {
+			logger.WithField("stream", stream.Input.ID).Warn("stream.RestartRecording is nil!")
+		}
+	}
+
+	check := func(i int) {
+		stream := &streams[i]
+		input := stream.Input
+		logger := logger.WithField("stream", input.ID)
+
+		if stream.Paused.Load() {
+			// start over when recording resumes, like on boot
+			stream.LastRestartInErr.Store(true)
+			stream.LastFileOpenedInErr.Store(true)
+			stream.LastSegmentOpenedInErr.Store(true)
+			stream.PlaylistStalledInErr.Store(true)
+			stream.SegmentStalledInErr.Store(true)
+			return
+		}
+
+		restartThreshold := input.RestartErrThreshold()
+		lastRestart := stream.LastRestart.Load()
+		lastRestartInErr := time.Since(lastRestart) < restartThreshold
+		lastRestartCurrentlyInErr := stream.LastRestartInErr.Load()
+
+		if lastRestartInErr && !lastRestartCurrentlyInErr {
+			logger.WithField("last-restart", lastRestart).WithField("threshold", restartThreshold.String()).Warn("stream restarted recently")
+		} else if !lastRestartInErr && lastRestartCurrentlyInErr {
+			logger.WithField("last-restart", lastRestart).WithField("threshold", restartThreshold.String()).Info("stream has been up for a while")
+		}
+
+		fileOpenedThreshold := input.FileOpenedErrThreshold()
+		lastFileOpened := stream.LastFileOpened.Load()
+		lastFileOpenedInErr := time.Since(lastFileOpened) > fileOpenedThreshold
+		lastFileOpenedCurrentlyInErr := stream.LastFileOpenedInErr.Load()
+
+		if lastFileOpenedInErr && !lastFileOpenedCurrentlyInErr {
+			logger.WithField("last-open", lastFileOpened).WithField("threshold", fileOpenedThreshold.String()).Warn("stream has not opened file recently, restarting")
+			restart(stream)
+		} else if !lastFileOpenedInErr && lastFileOpenedCurrentlyInErr {
+			logger.WithField("last-open", lastFileOpened).WithField("threshold", fileOpenedThreshold.String()).Info("stream has opened a file recently")
+		}
+
+		segmentOpenedThreshold := input.SegmentOpenedErrThreshold()
+		lastSegmentOpened := stream.LastSegmentOpened.Load()
+		lastSegmentOpenedInErr := time.Since(lastSegmentOpened) > segmentOpenedThreshold
+		lastSegmentOpenedCurrentlyInErr := stream.LastSegmentOpenedInErr.Load()
+
+		if lastSegmentOpenedInErr && !lastSegmentOpenedCurrentlyInErr {
+			logger.WithField("last-open", lastSegmentOpened).WithField("threshold", segmentOpenedThreshold.String()).Warn("stream has not opened segment recently, restarting")
+			restart(stream)
+		} else if !lastSegmentOpenedInErr && lastSegmentOpenedCurrentlyInErr {
+			logger.WithField("last-open", lastSegmentOpened).WithField("threshold", segmentOpenedThreshold.String()).Info("stream has opened a segment recently")
+		}
+
+		// ffmpeg can keep logging while producing nothing, so also check the files themselves.
+		// Progress is measured from the last restart so streams have time to start up.
+		stallThreshold := input.StallThreshold()
+
+		lastPlaylistWrite := lastRestart
+		if info, err := os.Stat(input.StreamPlaylistPath()); err == nil && info.ModTime().After(lastPlaylistWrite) {
+			lastPlaylistWrite = info.ModTime()
+		}
+		playlistStalledInErr := time.Since(lastPlaylistWrite) > stallThreshold
+		playlistStalledCurrentlyInErr := stream.PlaylistStalledInErr.Load()
+
+		if playlistStalledInErr && !playlistStalledCurrentlyInErr {
+			logger.WithField("last-write", lastPlaylistWrite).WithField("threshold", stallThreshold.String()).Warn("stream playlist has not been written recently, restarting")
+			restart(stream)
+		} else if !playlistStalledInErr && playlistStalledCurrentlyInErr {
+			logger.WithField("last-write", lastPlaylistWrite).WithField("threshold", stallThreshold.String()).Info("stream playlist has been written recently")
+		}
+
+		segment := stream.LastSegmentOpenedName.Load()
+		if segment != growth[i].name {
+			growth[i] = segmentGrowth{name: segment, lastGrew: time.Now()}
+		} else if info, err := os.Stat(segment); err == nil && info.Size() > growth[i].size {
+			growth[i].size = info.Size()
+			growth[i].lastGrew = time.Now()
+		}
+		lastSegmentGrowth := growth[i].lastGrew
+		if lastRestart.After(lastSegmentGrowth) {
+			lastSegmentGrowth = lastRestart
+		}
+		segmentStalledInErr := time.Since(lastSegmentGrowth) > stallThreshold
+		segmentStalledCurrentlyInErr := stream.SegmentStalledInErr.Load()
+
+		if segmentStalledInErr && !segmentStalledCurrentlyInErr {
+			logger.WithField("segment", segment).WithField("last-growth", lastSegmentGrowth).WithField("threshold", stallThreshold.String()).Warn("stream segment has not grown recently, restarting")
+			restart(stream)
+		} else if !segmentStalledInErr && segmentStalledCurrentlyInErr {
+			logger.WithField("segment", segment).WithField("last-growth", lastSegmentGrowth).WithField("threshold", stallThreshold.String()).Info("stream segment has grown recently")
+		}
+
+		previouslyFailing := stream.FailingChecks()
+		stream.LastRestartInErr.Store(lastRestartInErr)
+		stream.LastFileOpenedInErr.Store(lastFileOpenedInErr)
+		stream.LastSegmentOpenedInErr.Store(lastSegmentOpenedInErr)
+		stream.PlaylistStalledInErr.Store(playlistStalledInErr)
+		stream.SegmentStalledInErr.Store(segmentStalledInErr)
+		publishCheckEvents(stream, previouslyFailing)
+	}
+
+	interval := watchdogInterval(streams)
+	logger.WithField("interval", interval.String()).Debug("starting watchdog")
+
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			for i := range streams {
+				check(i)
+			}
+			timer.Reset(interval)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type Webhook struct {
+	// Name identifies this webhook in logs, metrics and the delivery log.
+	// Defaults to the URL's host.
+	Name string `json:"name"`
+	// URL is where requests are sent
+	URL string `json:"url"`
+	// Method defaults to POST
+	Method string `json:"method"`
+	// Headers are added to every request, for example {"Authorization": "Bearer ..."}
+	Headers map[string]string `json:"headers"`
+	// Template is a Go text/template rendering the request body.
+	// It receives the event (.Type, .Time, .StreamID, .Stream, .Recording) and a human-readable .Message,
+	// and can use {{json .Message}} to embed a value as JSON.
+	// If empty, the event itself is sent as JSON.
+	Template string `json:"template"`
+	// Events are the event types that trigger this webhook, see /api/events.
+	// Defaults to stream.offline, stream.online, stream.crashloop and stream.recovered.
+	Events []string `json:"events"`
+	// Streams are the Input IDs that trigger this webhook.
+	// If empty, every stream triggers it.
+	Streams []string `json:"streams"`
+	// MaxAttempts is how many times a delivery is tried before giving up.
+	// Defaults to 5.
+	MaxAttempts int `json:"max_attempts"`
+	// TimeoutSeconds is how long each attempt can take.
+	// Defaults to 10.
+	TimeoutSeconds int `json:"timeout_seconds"`
+}
+
+var defaultWebhookEvents = []string{EventStreamOffline, EventStreamOnline, EventStreamCrashLoop, EventStreamRecovered}
+
+// webhookPayload is what Webhook.Template is executed with
+type webhookPayload struct {
+	ApiV1Event
+	Message string
+	// SnapshotBase64 is the base64-encoded JPEG snapshot of a motion.alert event, if there is one
+	SnapshotBase64 string
+}
+
+// eventMessage describes the event for humans
+func eventMessage(event ApiV1Event) string {
+	name := event.StreamID
+	if event.Stream != nil && event.Stream.Name != "" {
+		name = event.Stream.Name
+	} else if event.Recording != nil && event.Recording.StreamName != "" {
+		name = event.Recording.StreamName
+	}
+
+	switch event.Type {
+	case EventStreamOffline:
+		return fmt.Sprintf("%v is offline (%v)", name, strings.Join(event.Stream.FailingChecks, ", "))
+	case EventStreamOnline:
+		return fmt.Sprintf("%v is back online", name)
+	case EventStreamCrashLoop:
+		message := fmt.Sprintf("%v is crash-looping after %v failures", name, event.Stream.ConsecutiveFailures)
+		if event.Stream.LastErrorReason != "" {
+			message += fmt.Sprintf(" (%v)", event.Stream.LastErrorReason)
+		}
+		return message
+	case EventStreamRecovered:
+		return fmt.Sprintf("%v has recovered", name)
+	case EventMotionStart:
+		return fmt.Sprintf("Motion started on %v", name)
+	case EventMotionStop:
+		return fmt.Sprintf("Motion stopped on %v after %v (peak score %v)", name, event.LiveMotion.End.Sub(event.LiveMotion.Start).Round(time.Second), event.LiveMotion.PeakScore)
+	case EventMotionAlert:
+		return fmt.Sprintf("Motion on %v at %v (score %v): %v", name, event.Alert.PeakTime.Local().Format("2006-01-02 15:04:05"), event.Alert.PeakScore, event.Alert.Link)
+	}
+	return fmt.Sprintf("%v: %v", name, event.Type)
+}
+
+type ApiV1WebhookDelivery struct {
+	Webhook    string    `json:"webhook"`
+	EventID    uint64    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	StreamID   string    `json:"stream_id"`
+	Time       time.Time `json:"time"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+}
+
+// webhookDeliveryLogSize is how many deliveries are kept for /api/webhooks/deliveries
+const webhookDeliveryLogSize = 200
+
+type compiledWebhook struct {
+	Webhook
+	template *template.Template
+}
+
+// WebhookDispatcher sends events to the configured webhooks
+type WebhookDispatcher struct {
+	webhooks []compiledWebhook
+	client   *http.Client
+	wg       sync.WaitGroup
+	stopped  chan struct{}
+
+	logLock sync.Mutex
+	log     []ApiV1WebhookDelivery
+}
+
+func NewWebhookDispatcher(webhooks []Webhook) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		client:  &http.Client{},
+		stopped: make(chan struct{}),
+	}
+	for i, webhook := range webhooks {
+		parsed, err := url.Parse(webhook.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("webhook %v has an invalid url, expected http:// or https://", i)
+		}
+		if webhook.Name == "" {
+			webhook.Name = parsed.Host
+		}
+		if webhook.Method == "" {
+			webhook.Method = http.MethodPost
+		}
+		if len(webhook.Events) == 0 {
+			webhook.Events = defaultWebhookEvents
+		}
+		for _, eventType := range webhook.Events {
+			if !slices.Contains(eventTypes, eventType) {
+				return nil, fmt.Errorf("webhook %v has an unknown event type %v", webhook.Name, eventType)
+			}
+		}
+		if webhook.MaxAttempts <= 0 {
+			webhook.MaxAttempts = 5
+		}
+		if webhook.TimeoutSeconds <= 0 {
+			webhook.TimeoutSeconds = 10
+		}
+
+		compiled := compiledWebhook{Webhook: webhook}
+		if webhook.Template != "" {
+			compiled.template, err = template.New(webhook.Name).Funcs(template.FuncMap{
+				"json": func(v any) (string, error) {
+					encoded, err := json.Marshal(v)
+					return string(encoded), err
+				},
+			}).Parse(webhook.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %v has an invalid template: %v", webhook.Name, err)
+			}
+		}
+		d.webhooks = append(d.webhooks, compiled)
+	}
+	return d, nil
+}
+
+func (w compiledWebhook) matches(event ApiV1Event) bool {
+	return slices.Contains(w.Events, event.Type) && (len(w.Streams) == 0 || slices.Contains(w.Streams, event.StreamID))
+}
+
+func (w compiledWebhook) body(event ApiV1Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(&event)
+	}
+	payload := webhookPayload{ApiV1Event: event, Message: eventMessage(event)}
+	if event.Alert != nil && event.Alert.SnapshotPath != "" {
+		if snapshot, err := os.ReadFile(strings.TrimPrefix(event.Alert.SnapshotPath, "/")); err == nil {
+			payload.SnapshotBase64 = base64.StdEncoding.EncodeToString(snapshot)
+		}
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// attempt sends a single request, returning the status code and whether it's worth trying again
+func (d *WebhookDispatcher) attempt(ctx context.Context, webhook compiledWebhook, body []byte) (int, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(webhook.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, webhook.Method, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "creamy-nvr")
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return resp.StatusCode, retry, fmt.Errorf("unexpected status %v", resp.Status)
+}
+
+// deliver sends the event to the webhook, retrying with exponential backoff.
+// Retries stop once ctx is cancelled, requests in flight are cancelled with workCtx.
+func (d *WebhookDispatcher) deliver(ctx, workCtx context.Context, webhook compiledWebhook, event ApiV1Event) {
+	logger := logger.WithField("unit", "webhooks").WithField("webhook", webhook.Name).WithField("event", event.Type).WithField("stream", event.StreamID)
+	delivery := ApiV1WebhookDelivery{
+		Webhook:   webhook.Name,
+		EventID:   event.ID,
+		EventType: event.Type,
+		StreamID:  event.StreamID,
+		Time:      time.Now(),
+	}
+
+	body, err := webhook.body(event)
+	if err != nil {
+		delivery.Error = fmt.Sprintf("failed to render template: %v", err)
+	} else {
+		for delivery.Attempts < webhook.MaxAttempts {
+			if delivery.Attempts > 0 {
+				delay := time.Duration(math.Min(float64(time.Minute), float64(time.Second)*math.Pow(2, float64(delivery.Attempts-1))))
+				logger.WithError(err).WithField("attempt", delivery.Attempts).WithField("delay", delay.String()).Warn("webhook delivery failed, retrying")
+				select {
+				case <-ctx.Done():
+				case <-time.After(delay):
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+
+			var retry bool
+			delivery.Attempts++
+			delivery.StatusCode, retry, err = d.attempt(workCtx, webhook, body)
+			if err == nil {
+				delivery.Delivered = true
+				delivery.Error = ""
+				break
+			}
+			delivery.Error = err.Error()
+			if !retry {
+				break
+			}
+		}
+	}
+
+	if delivery.Delivered {
+		logger.WithField("attempts", delivery.Attempts).Debug("delivered webhook")
+		metrics.WebhookDeliveries.Add(1, "webhook", webhook.Name, "result", "delivered")
+	} else {
+		logger.WithField("attempts", delivery.Attempts).WithField("error", delivery.Error).Error("failed to deliver webhook")
+		metrics.WebhookDeliveries.Add(1, "webhook", webhook.Name, "result", "failed")
+	}
+
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+	d.log = append(d.log, delivery)
+	if len(d.log) > webhookDeliveryLogSize {
+		d.log = d.log[len(d.log)-webhookDeliveryLogSize:]
+	}
+}
+
+// Run sends every published event to the matching webhooks until ctx is cancelled
+func (d *WebhookDispatcher) Run(ctx, workCtx context.Context) {
+	defer close(d.stopped)
+	if len(d.webhooks) == 0 {
+		return
+	}
+
+	subscription, unsubscribe := events.Subscribe(256)
+	defer func() { unsubscribe() }()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-subscription:
+			if !ok {
+				logger.WithField("unit", "webhooks").Error("fell behind on events, some webhooks were not sent")
+				subscription, unsubscribe = events.Subscribe(256)
+				continue
+			}
+			for _, webhook := range d.webhooks {
+				if webhook.matches(event) {
+					d.wg.Add(1)
+					go func() {
+						defer d.wg.Done()
+						d.deliver(ctx, workCtx, webhook, event)
+					}()
+				}
+			}
+		}
+	}
+}
+
+// Wait blocks until Run has returned and every delivery in progress has finished
+func (d *WebhookDispatcher) Wait() {
+	<-d.stopped
+	d.wg.Wait()
+}
+
+// Deliveries returns the most recent deliveries, newest first
+func (d *WebhookDispatcher) Deliveries() []ApiV1WebhookDelivery {
+	d.logLock.Lock()
+	defer d.logLock.Unlock()
+	deliveries := slices.Clone(d.log)
+	slices.Reverse(deliveries)
+	return deliveries
+}
@@ -0,0 +1,54 @@
+package main
+
+import "fmt"
+
+type MotionZone struct {
+	// Name identifies the zone in motion results, like "driveway".
+	// Required for include zones.
+	Name string `json:"name,omitempty"`
+	// Points are the corners of the polygon as [x, y], from [0, 0] at the top left of the frame to [1, 1] at the bottom right
+	Points [][2]float64 `json:"points"`
+	// Exclude ignores motion inside the polygon, like a road, trees or a timestamp overlay.
+	// Otherwise, only motion inside include zones is counted.
+	Exclude bool `json:"exclude,omitempty"`
+}
+
+// contains returns true if the normalized point is inside the polygon, using the even-odd rule
+func (z MotionZone) contains(x, y float64) bool {
+	inside := false
+	for i, j := 0, len(z.Points)-1; i < len(z.Points); j, i = i, i+1 {
+		xi, yi := z.Points[i][0], z.Points[i][1]
+		xj, yj := z.Points[j][0], z.Points[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// validateMotionZones makes sure every zone is a polygon within the frame, and include zones have unique names
+func (i Input) validateMotionZones() error {
+	names := map[string]bool{}
+	for idx, zone := range i.MotionZones {
+		if len(zone.Points) < 3 {
+			return fmt.Errorf("motion zone %v needs at least 3 points", idx)
+		}
+		for _, point := range zone.Points {
+			if point[0] < 0 || point[0] > 1 || point[1] < 0 || point[1] > 1 {
+				return fmt.Errorf("motion zone %v has a point outside of the frame, expected coordinates between 0 and 1", idx)
+			}
+		}
+		if zone.Exclude {
+			continue
+		}
+		if zone.Name == "" {
+			return fmt.Errorf("motion zone %v needs a name", idx)
+		}
+		if names[zone.Name] {
+			return fmt.Errorf("motion zone %v is defined twice", zone.Name)
+		}
+		names[zone.Name] = true
+	}
+	_, err := newPixelDiffScorer(i.PixelDiff, i.MotionZones)
+	return err
+}